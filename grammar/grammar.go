@@ -0,0 +1,463 @@
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Grammar is a context-free grammar compiled from GBNF.
+//
+// Repetitions, optionals and groups are desugared into helper rules while
+// parsing, so every rule is a plain list of alternatives made of
+// character-class and rule-reference elements.
+type Grammar struct {
+	rules []rule
+	names map[string]int
+	root  int
+}
+
+type rule struct {
+	name string
+	alts [][]element
+}
+
+type elementKind int
+
+const (
+	elemChar elementKind = iota // matches one character from ranges
+	elemRule                    // expands another rule
+)
+
+type runeRange struct {
+	lo, hi rune
+}
+
+type element struct {
+	kind   elementKind
+	ranges []runeRange
+	negate bool
+	rule   int
+}
+
+func (e element) matches(r rune) bool {
+	in := false
+	for _, rg := range e.ranges {
+		if r >= rg.lo && r <= rg.hi {
+			in = true
+			break
+		}
+	}
+	return in != e.negate
+}
+
+// mayMatch reports whether some rune in [lo, hi] could match. Negated
+// classes are answered conservatively.
+func (e element) mayMatch(lo, hi rune) bool {
+	if e.negate {
+		return true
+	}
+	for _, rg := range e.ranges {
+		if rg.lo <= hi && lo <= rg.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse compiles a grammar written in GBNF, the BNF dialect used by
+// llama.cpp:
+//
+//	root   ::= object
+//	object ::= "{" ws ( pair ( "," ws pair )* )? "}"
+//	ws     ::= [ \t\n]*
+//
+// Supported are string literals, character classes (including negated
+// ones), ".", groups, alternatives and the *, +, ? and {m,n} operators.
+// Comments start with #. Generation starts at the rule named root.
+func Parse(src string) (*Grammar, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks, g: &Grammar{names: make(map[string]int)}, helpers: make(map[int]bool)}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	return p.g, nil
+}
+
+// MustParse is like Parse but panics on error.
+func MustParse(src string) *Grammar {
+	g, err := Parse(src)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+type tokenKind int
+
+const (
+	tokName tokenKind = iota
+	tokString
+	tokClass
+	tokDefine // ::=
+	tokSymbol // | ( ) * + ? .
+	tokRepeat // {m,n}
+	tokEOF
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// parsed payloads
+	runes    []rune      // tokString
+	ranges   []runeRange // tokClass
+	negate   bool        // tokClass
+	min, max int         // tokRepeat, max < 0 means unbounded
+}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case isNameChar(c):
+			start := i
+			for i < len(src) && isNameChar(src[i]) {
+				i++
+			}
+			toks = append(toks, token{kind: tokName, text: src[start:i]})
+		case strings.HasPrefix(src[i:], "::="):
+			toks = append(toks, token{kind: tokDefine, text: "::="})
+			i += 3
+		case c == '"':
+			var runes []rune
+			i++
+			for {
+				if i >= len(src) {
+					return nil, errors.New("unterminated string literal")
+				}
+				if src[i] == '"' {
+					i++
+					break
+				}
+				r, n, err := parseChar(src[i:])
+				if err != nil {
+					return nil, err
+				}
+				runes = append(runes, r)
+				i += n
+			}
+			toks = append(toks, token{kind: tokString, runes: runes})
+		case c == '[':
+			tok := token{kind: tokClass}
+			i++
+			if i < len(src) && src[i] == '^' {
+				tok.negate = true
+				i++
+			}
+			for {
+				if i >= len(src) {
+					return nil, errors.New("unterminated character class")
+				}
+				if src[i] == ']' {
+					i++
+					break
+				}
+				lo, n, err := parseChar(src[i:])
+				if err != nil {
+					return nil, err
+				}
+				i += n
+				hi := lo
+				if i+1 < len(src) && src[i] == '-' && src[i+1] != ']' {
+					hi, n, err = parseChar(src[i+1:])
+					if err != nil {
+						return nil, err
+					}
+					i += 1 + n
+				}
+				tok.ranges = append(tok.ranges, runeRange{lo, hi})
+			}
+			toks = append(toks, tok)
+		case c == '{':
+			end := strings.IndexByte(src[i:], '}')
+			if end < 0 {
+				return nil, errors.New("unterminated repetition")
+			}
+			tok, err := parseRepeat(src[i+1 : i+end])
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, tok)
+			i += end + 1
+		case strings.IndexByte("|()*+?.", c) >= 0:
+			toks = append(toks, token{kind: tokSymbol, text: string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+		}
+	}
+	return append(toks, token{kind: tokEOF}), nil
+}
+
+func isNameChar(c byte) bool {
+	return c == '-' || c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// parseChar decodes one possibly escaped character of a literal or class.
+func parseChar(s string) (rune, int, error) {
+	if s[0] != '\\' {
+		r, n := utf8.DecodeRuneInString(s)
+		if r == utf8.RuneError && n <= 1 {
+			return 0, 0, errors.New("invalid UTF-8 in grammar")
+		}
+		return r, n, nil
+	}
+	if len(s) < 2 {
+		return 0, 0, errors.New("dangling escape")
+	}
+	switch s[1] {
+	case 'n':
+		return '\n', 2, nil
+	case 'r':
+		return '\r', 2, nil
+	case 't':
+		return '\t', 2, nil
+	case 'x', 'u', 'U':
+		width := map[byte]int{'x': 2, 'u': 4, 'U': 8}[s[1]]
+		if len(s) < 2+width {
+			return 0, 0, errors.New("truncated escape")
+		}
+		v, err := strconv.ParseUint(s[2:2+width], 16, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid escape %q", s[:2+width])
+		}
+		return rune(v), 2 + width, nil
+	default:
+		r, n := utf8.DecodeRuneInString(s[1:])
+		return r, 1 + n, nil
+	}
+}
+
+func parseRepeat(body string) (token, error) {
+	tok := token{kind: tokRepeat}
+	lo, hi, found := strings.Cut(body, ",")
+	var err error
+	if tok.min, err = strconv.Atoi(strings.TrimSpace(lo)); err != nil {
+		return tok, fmt.Errorf("invalid repetition {%s}", body)
+	}
+	switch {
+	case !found:
+		tok.max = tok.min
+	case strings.TrimSpace(hi) == "":
+		tok.max = -1
+	default:
+		if tok.max, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil || tok.max < tok.min {
+			return tok, fmt.Errorf("invalid repetition {%s}", body)
+		}
+	}
+	return tok, nil
+}
+
+type parser struct {
+	toks    []token
+	pos     int
+	g       *Grammar
+	helpers map[int]bool
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	p.pos++
+	return t
+}
+
+// ruleID returns the index of the named rule, creating an empty one on
+// first use so rules can be referenced before they are defined.
+func (p *parser) ruleID(name string) int {
+	if id, ok := p.g.names[name]; ok {
+		return id
+	}
+	p.g.rules = append(p.g.rules, rule{name: name})
+	p.g.names[name] = len(p.g.rules) - 1
+	return len(p.g.rules) - 1
+}
+
+// helperRule adds an anonymous rule and returns its index.
+func (p *parser) helperRule(base string, alts [][]element) int {
+	// "/" cannot appear in rule names, so helpers never clash with user rules
+	name := fmt.Sprintf("%s/%d", base, len(p.g.rules))
+	id := p.ruleID(name)
+	p.g.rules[id].alts = alts
+	p.helpers[id] = true
+	return id
+}
+
+func (p *parser) parse() error {
+	defined := make(map[string]bool)
+	for p.peek().kind != tokEOF {
+		name := p.next()
+		if name.kind != tokName {
+			return fmt.Errorf("expected rule name, got %q", name.text)
+		}
+		if p.next().kind != tokDefine {
+			return fmt.Errorf("expected ::= after %s", name.text)
+		}
+		if defined[name.text] {
+			return fmt.Errorf("rule %s defined twice", name.text)
+		}
+		defined[name.text] = true
+		id := p.ruleID(name.text)
+		alts, err := p.alternates(name.text)
+		if err != nil {
+			return fmt.Errorf("rule %s: %v", name.text, err)
+		}
+		p.g.rules[id].alts = alts
+	}
+
+	for id, r := range p.g.rules {
+		if !p.helpers[id] && !defined[r.name] {
+			return fmt.Errorf("undefined rule %s", r.name)
+		}
+	}
+	root, ok := p.g.names["root"]
+	if !ok {
+		return errors.New("grammar has no root rule")
+	}
+	p.g.root = root
+	return nil
+}
+
+func (p *parser) alternates(base string) ([][]element, error) {
+	var alts [][]element
+	for {
+		seq, err := p.sequence(base)
+		if err != nil {
+			return nil, err
+		}
+		alts = append(alts, seq)
+		if t := p.peek(); t.kind == tokSymbol && t.text == "|" {
+			p.next()
+			continue
+		}
+		return alts, nil
+	}
+}
+
+// sequence parses items until |, ), the end of input or the start of the
+// next rule definition.
+func (p *parser) sequence(base string) ([]element, error) {
+	seq := []element{}
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == tokEOF:
+			return seq, nil
+		case t.kind == tokSymbol && (t.text == "|" || t.text == ")"):
+			return seq, nil
+		case t.kind == tokName && p.toks[p.pos+1].kind == tokDefine:
+			return seq, nil
+		}
+		item, err := p.primary(base)
+		if err != nil {
+			return nil, err
+		}
+		item, err = p.repetition(base, item)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, item...)
+	}
+}
+
+func (p *parser) primary(base string) ([]element, error) {
+	t := p.next()
+	switch t.kind {
+	case tokName:
+		return []element{{kind: elemRule, rule: p.ruleID(t.text)}}, nil
+	case tokString:
+		seq := make([]element, len(t.runes))
+		for i, r := range t.runes {
+			seq[i] = element{kind: elemChar, ranges: []runeRange{{r, r}}}
+		}
+		return seq, nil
+	case tokClass:
+		return []element{{kind: elemChar, ranges: t.ranges, negate: t.negate}}, nil
+	case tokSymbol:
+		switch t.text {
+		case ".":
+			return []element{{kind: elemChar, negate: true}}, nil
+		case "(":
+			alts, err := p.alternates(base)
+			if err != nil {
+				return nil, err
+			}
+			if closing := p.next(); closing.kind != tokSymbol || closing.text != ")" {
+				return nil, errors.New("expected )")
+			}
+			return []element{{kind: elemRule, rule: p.helperRule(base, alts)}}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected token %q", t.text)
+}
+
+// repetition applies a trailing *, +, ? or {m,n} to item.
+func (p *parser) repetition(base string, item []element) ([]element, error) {
+	t := p.peek()
+	lo, hi := 1, 1
+	switch {
+	case t.kind == tokSymbol && t.text == "*":
+		lo, hi = 0, -1
+	case t.kind == tokSymbol && t.text == "+":
+		lo, hi = 1, -1
+	case t.kind == tokSymbol && t.text == "?":
+		lo, hi = 0, 1
+	case t.kind == tokRepeat:
+		lo, hi = t.min, t.max
+	default:
+		return item, nil
+	}
+	p.next()
+
+	var out []element
+	for i := 0; i < lo; i++ {
+		out = append(out, item...)
+	}
+	if hi < 0 {
+		// star ::= item star | ε
+		star := p.helperRule(base, nil)
+		p.g.rules[star].alts = [][]element{
+			append(append([]element{}, item...), element{kind: elemRule, rule: star}),
+			{},
+		}
+		return append(out, element{kind: elemRule, rule: star}), nil
+	}
+	// opt_k ::= item opt_{k+1} | ε, nested hi-lo times
+	tail := -1
+	for i := 0; i < hi-lo; i++ {
+		alt := append([]element{}, item...)
+		if tail >= 0 {
+			alt = append(alt, element{kind: elemRule, rule: tail})
+		}
+		tail = p.helperRule(base, [][]element{alt, {}})
+	}
+	if tail >= 0 {
+		out = append(out, element{kind: elemRule, rule: tail})
+	}
+	return out, nil
+}
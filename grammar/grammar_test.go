@@ -0,0 +1,225 @@
+package grammar
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// testVocab has every printable ASCII character as a token, a few longer
+// tokens, and the two halves of "é" as separate byte tokens.
+func testVocab() [][]byte {
+	var vocab [][]byte
+	for c := byte(' '); c < 0x7f; c++ {
+		vocab = append(vocab, []byte{c})
+	}
+	vocab = append(vocab, []byte("\n"), []byte("true"), []byte("false"), []byte(`":`), []byte(" {"), []byte{0xc3}, []byte{0xa9})
+	return vocab
+}
+
+// tokenize splits text greedily into the longest tokens of vocab.
+func tokenize(t *testing.T, vocab [][]byte, text string) []uint32 {
+	t.Helper()
+	var ids []uint32
+	for len(text) > 0 {
+		best, bestLen := -1, 0
+		for i, tok := range vocab {
+			if len(tok) > bestLen && strings.HasPrefix(text, string(tok)) {
+				best, bestLen = i, len(tok)
+			}
+		}
+		if best < 0 {
+			t.Fatalf("cannot tokenize %q", text)
+		}
+		ids = append(ids, uint32(best))
+		text = text[bestLen:]
+	}
+	return ids
+}
+
+// matches reports whether text is accepted completely by g.
+func matches(t *testing.T, g *Grammar, text string) bool {
+	t.Helper()
+	vocab := testVocab()
+	m, err := NewMatcher(g, vocab)
+	if err != nil {
+		t.Fatalf("NewMatcher failed: %v", err)
+	}
+	for _, id := range tokenize(t, vocab, text) {
+		allowed := m.Allowed()[id]
+		err := m.Accept(id)
+		if allowed != (err == nil) {
+			t.Fatalf("Allowed and Accept disagree on %q in %q", vocab[id], text)
+		}
+		if err != nil {
+			return false
+		}
+	}
+	return m.CanEnd()
+}
+
+func TestParse(t *testing.T) {
+	g, err := Parse(`
+# a comment
+root   ::= greeting ("," ws name)? "!"
+greeting ::= "hello" | "hi"
+name   ::= [A-Z] [a-z]{1,5}
+ws     ::= [ \t]*
+`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	for text, expected := range map[string]bool{
+		"hello!":        true,
+		"hi, Bob!":      true,
+		"hi,Alice!":     true,
+		"hi, Bo":        false,
+		"hi, Bobbbbbb!": false,
+		"hey!":          false,
+		"hello":         false,
+	} {
+		if actual := matches(t, g, text); actual != expected {
+			t.Errorf("matches(%q) = %v, expected %v", text, actual, expected)
+		}
+	}
+
+	for _, src := range []string{
+		`root ::= missing`,
+		`other ::= "x"`,
+		`root ::= "unterminated`,
+		`root ::= [a-`,
+		`root ::= "a"{3,1}`,
+	} {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("Parse(%q) should fail", src)
+		}
+	}
+}
+
+func TestMatcherAllowed(t *testing.T) {
+	g := MustParse(`root ::= "{" ( "true" | "false" ) "}"`)
+	vocab := testVocab()
+	m, err := NewMatcher(g, vocab)
+	if err != nil {
+		t.Fatalf("NewMatcher failed: %v", err)
+	}
+	if err := m.Accept(tokenize(t, vocab, "{")[0]); err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	var allowed []string
+	for i, ok := range m.Allowed() {
+		if ok {
+			allowed = append(allowed, string(vocab[i]))
+		}
+	}
+	if strings.Join(allowed, " ") != "f t true false" {
+		t.Errorf("Unexpected allowed tokens %q", allowed)
+	}
+	if m.CanEnd() || m.Done() {
+		t.Errorf("Matcher must not be able to end after %q", "{")
+	}
+	for _, id := range tokenize(t, vocab, "true}") {
+		if err := m.Accept(id); err != nil {
+			t.Fatalf("Accept failed: %v", err)
+		}
+	}
+	if !m.CanEnd() || !m.Done() {
+		t.Errorf("Matcher should be done")
+	}
+}
+
+func TestMatcherPartialUTF8(t *testing.T) {
+	g := MustParse(`root ::= "caf" [é]`)
+	if !matches(t, g, "café") {
+		t.Errorf("café should match when é is split over two tokens")
+	}
+	g = MustParse(`root ::= "caf" [è]`)
+	if matches(t, g, "café") {
+		t.Errorf("café should not match [è]")
+	}
+	vocab := testVocab()
+	m, _ := NewMatcher(MustParse(`root ::= [^a-z]`), vocab)
+	if !m.Allowed()[len(vocab)-2] {
+		t.Errorf("The first byte of é should be allowed by a negated class")
+	}
+}
+
+func TestLeftRecursion(t *testing.T) {
+	g := MustParse(`root ::= root "a" | "a"`)
+	if _, err := NewMatcher(g, testVocab()); err == nil {
+		t.Errorf("Left-recursive grammar should be rejected")
+	}
+}
+
+func TestFromJSONSchema(t *testing.T) {
+	schema := `{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string"},
+			"age": {"type": "integer"},
+			"tags": {"type": "array", "items": {"enum": ["a", "b"]}, "maxItems": 2},
+			"pet": {"anyOf": [{"type": "null"}, {"type": "object", "properties": {"kind": {"const": "cat"}}, "required": ["kind"]}]}
+		},
+		"required": ["name"]
+	}`
+	g, err := FromJSONSchema([]byte(schema))
+	if err != nil {
+		t.Fatalf("FromJSONSchema failed: %v", err)
+	}
+	for text, expected := range map[string]bool{
+		`{"name":"Tom"}`:                      true,
+		`{ "name": "Tom", "age": 3 }`:         true,
+		`{"name":"Tom","tags":["a","b"]}`:     true,
+		`{"name":"Tom","pet":{"kind":"cat"}}`: true,
+		`{"name":"Tom","age":3,"pet":null}`:   true,
+		`{"age":3}`:                           false,
+		`{"name":"Tom",}`:                     false,
+		`{"name":"Tom","age":3.5}`:            false,
+		`{"name":"Tom","tags":["a","b","a"]}`: false,
+		`{"name":"Tom","tags":["c"]}`:         false,
+		`{"age":3,"name":"Tom"}`:              false,
+		`{"name":"Tom","pet":{"kind":"dog"}}`: false,
+		`{"name":"Tom","extra":1}`:            false,
+		`{"name":"a\"b\\c"}`:                  true,
+		`{"name":"Tom"}` + "\n":               false,
+	} {
+		if actual := matches(t, g, text); actual != expected {
+			t.Errorf("matches(%s) = %v, expected %v", text, actual, expected)
+		}
+		if expected && !json.Valid([]byte(text)) {
+			t.Errorf("Test case %s is not valid JSON", text)
+		}
+	}
+
+	anyValue, err := FromJSONSchema([]byte(`{}`))
+	if err != nil {
+		t.Fatalf("FromJSONSchema failed: %v", err)
+	}
+	if !matches(t, anyValue, `{"x":[1,-2.5e3,true,null,{}]}`) {
+		t.Errorf("Empty schema should accept any JSON value")
+	}
+
+	// property names that look like helper rules or differ only in
+	// characters not allowed in rule names
+	tricky, err := FromJSONSchema([]byte(`{
+		"properties": {"a": {"type": "integer"}, "tail1": {"type": "string"}, "c": {"type": "integer"}, "a_b": {"type": "null"}, "a-b": {"type": "boolean"}},
+		"required": ["a", "tail1", "c"]
+	}`))
+	if err != nil {
+		t.Fatalf("FromJSONSchema failed: %v", err)
+	}
+	for text, expected := range map[string]bool{
+		`{"a":1,"tail1":"x","c":2}`:                       true,
+		`{"a":1,"tail1":"x","c":2,"a_b":null,"a-b":true}`: true,
+		`{"a":1,"tail1":"x","c":2,"a_b":true}`:            false,
+		`{"a":1"x"}`:                                      false,
+	} {
+		if actual := matches(t, tricky, text); actual != expected {
+			t.Errorf("matches(%s) = %v, expected %v", text, actual, expected)
+		}
+	}
+
+	if _, err := FromJSONSchema([]byte(`{"type": "date"}`)); err == nil {
+		t.Errorf("Unsupported types should be rejected")
+	}
+}
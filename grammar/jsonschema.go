@@ -0,0 +1,317 @@
+package grammar
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FromJSONSchema compiles a JSON Schema into a grammar accepting the JSON
+// documents that satisfy it. See JSONSchemaToGBNF for the supported subset.
+func FromJSONSchema(schema []byte) (*Grammar, error) {
+	src, err := JSONSchemaToGBNF(schema)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(src)
+}
+
+// JSONSchemaToGBNF translates a JSON Schema into GBNF.
+//
+// Supported keywords are type (including lists of types), properties,
+// required, items, minItems, maxItems, enum, const, anyOf and oneOf.
+// Properties are emitted in the order they are declared and no other
+// properties are allowed. An empty schema accepts any JSON value.
+func JSONSchemaToGBNF(schema []byte) (string, error) {
+	c := &schemaCompiler{rules: make(map[string]string)}
+	root, err := c.compile("root", schema)
+	if err != nil {
+		return "", err
+	}
+	if root != "root" {
+		c.rules["root"] = root
+	}
+
+	names := make([]string, 0, len(c.rules))
+	for name := range c.rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s ::= %s\n", name, c.rules[name])
+	}
+	return sb.String(), nil
+}
+
+// primitive rules shared by all schemas
+var jsonPrimitives = map[string]string{
+	"ws":      `[ \t\n]{0,2}`,
+	"string":  `"\"" ( [^"\\\x00-\x1f] | "\\" ( ["\\/bfnrt] | "u" [0-9a-fA-F]{4} ) )* "\""`,
+	"integer": `"-"? ( "0" | [1-9] [0-9]* )`,
+	"number":  `"-"? ( "0" | [1-9] [0-9]* ) ( "." [0-9]+ )? ( [eE] [-+]? [0-9]+ )?`,
+	"boolean": `"true" | "false"`,
+	"null":    `"null"`,
+	"value":   `object | array | string | number | boolean | null`,
+	"object":  `"{" ws ( string ws ":" ws value ws ( "," ws string ws ":" ws value ws )* )? "}"`,
+	"array":   `"[" ws ( value ws ( "," ws value ws )* )? "]"`,
+}
+
+type jsonSchema struct {
+	Type       schemaTypes       `json:"type"`
+	Properties json.RawMessage   `json:"properties"`
+	Required   []string          `json:"required"`
+	Items      json.RawMessage   `json:"items"`
+	MinItems   int               `json:"minItems"`
+	MaxItems   *int              `json:"maxItems"`
+	Enum       []json.RawMessage `json:"enum"`
+	Const      json.RawMessage   `json:"const"`
+	AnyOf      []json.RawMessage `json:"anyOf"`
+	OneOf      []json.RawMessage `json:"oneOf"`
+}
+
+// schemaTypes accepts both "type": "x" and "type": ["x", "y"].
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = []string{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("invalid type: %s", data)
+	}
+	*t = list
+	return nil
+}
+
+type schemaCompiler struct {
+	rules map[string]string
+}
+
+// primitive makes sure a shared rule and everything it uses are defined.
+func (c *schemaCompiler) primitive(name string) string {
+	if _, ok := c.rules[name]; ok {
+		return name
+	}
+	c.rules[name] = jsonPrimitives[name]
+	switch name {
+	case "value", "object", "array":
+		for _, dep := range []string{"ws", "string", "number", "boolean", "null", "value", "object", "array"} {
+			c.primitive(dep)
+		}
+	}
+	return name
+}
+
+// compile defines a rule for schema under name and returns the expression
+// to reference it.
+func (c *schemaCompiler) compile(name string, raw []byte) (string, error) {
+	var s jsonSchema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+
+	switch {
+	case len(s.Const) > 0:
+		return c.define(name, jsonLiteral(s.Const))
+	case len(s.Enum) > 0:
+		alts := make([]string, len(s.Enum))
+		for i, v := range s.Enum {
+			alts[i] = jsonLiteral(v)
+		}
+		return c.define(name, strings.Join(alts, " | "))
+	case len(s.AnyOf) > 0 || len(s.OneOf) > 0:
+		var alts []string
+		for i, sub := range append(s.AnyOf, s.OneOf...) {
+			ref, err := c.compile(fmt.Sprintf("%s-%d", name, i), sub)
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, ref)
+		}
+		return c.define(name, strings.Join(alts, " | "))
+	}
+
+	if len(s.Type) == 0 {
+		if len(s.Properties) > 0 {
+			s.Type = schemaTypes{"object"}
+		} else {
+			return c.primitive("value"), nil
+		}
+	}
+	var alts []string
+	for _, typ := range s.Type {
+		expr, err := c.compileType(name, typ, s)
+		if err != nil {
+			return "", err
+		}
+		alts = append(alts, expr)
+	}
+	return c.define(name, strings.Join(alts, " | "))
+}
+
+func (c *schemaCompiler) compileType(name, typ string, s jsonSchema) (string, error) {
+	switch typ {
+	case "string", "integer", "number", "boolean", "null":
+		return c.primitive(typ), nil
+	case "array":
+		return c.compileArray(name, s)
+	case "object":
+		return c.compileObject(name, s)
+	}
+	return "", fmt.Errorf("%s: unsupported type %q", name, typ)
+}
+
+func (c *schemaCompiler) compileArray(name string, s jsonSchema) (string, error) {
+	c.primitive("ws")
+	item := c.primitive("value")
+	if len(s.Items) > 0 {
+		var err error
+		if item, err = c.compile(name+"-item", s.Items); err != nil {
+			return "", err
+		}
+	}
+	if s.MaxItems != nil && *s.MaxItems < s.MinItems {
+		return "", fmt.Errorf("%s: maxItems is below minItems", name)
+	}
+
+	// first item, then the remaining ones each preceded by a comma
+	next := fmt.Sprintf(`( "," ws %s ws )`, item)
+	var rest string
+	switch {
+	case s.MaxItems == nil:
+		rest = fmt.Sprintf("%s{%d,}", next, max(s.MinItems-1, 0))
+	case *s.MaxItems == 0:
+		return `"[" ws "]"`, nil
+	default:
+		rest = fmt.Sprintf("%s{%d,%d}", next, max(s.MinItems-1, 0), *s.MaxItems-1)
+	}
+	items := fmt.Sprintf("%s ws %s", item, rest)
+	if s.MinItems == 0 {
+		items = fmt.Sprintf("( %s )?", items)
+	}
+	return fmt.Sprintf(`"[" ws %s "]"`, items), nil
+}
+
+func (c *schemaCompiler) compileObject(name string, s jsonSchema) (string, error) {
+	c.primitive("ws")
+	keys, err := orderedKeys(s.Properties)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	if len(keys) == 0 {
+		return c.primitive("object"), nil
+	}
+	var props map[string]json.RawMessage
+	if err := json.Unmarshal(s.Properties, &props); err != nil {
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	required := make(map[string]bool, len(s.Required))
+	for _, r := range s.Required {
+		required[r] = true
+	}
+
+	// rules are named by the property index, not its name: any two names
+	// can then never clash, neither with each other nor with the tails
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		value, err := c.compile(fmt.Sprintf("%s-p%d", name, i), props[key])
+		if err != nil {
+			return "", err
+		}
+		pairs[i] = fmt.Sprintf(`%s ws ":" ws %s ws`, jsonLiteral(mustMarshal(key)), value)
+	}
+
+	// tail(i, first) lists the properties from i on; first tells whether
+	// no property has been written yet, i.e. whether a comma is needed
+	var tail func(i int, first bool) string
+	tail = func(i int, first bool) string {
+		if i == len(keys) {
+			return ""
+		}
+		rule := fmt.Sprintf("%s-tail%d", name, i)
+		if first {
+			rule += "-first"
+		}
+		if _, ok := c.rules[rule]; ok {
+			return rule
+		}
+		c.rules[rule] = "" // reserve the name
+		with := pairs[i]
+		if !first {
+			with = `"," ws ` + with
+		}
+		if next := tail(i+1, false); next != "" {
+			with += " " + next
+		}
+		expr := with
+		if !required[keys[i]] {
+			without := tail(i+1, first)
+			if without == "" {
+				without = `""`
+			}
+			expr = fmt.Sprintf("( %s ) | %s", with, without)
+		}
+		c.rules[rule] = expr
+		return rule
+	}
+	return fmt.Sprintf(`"{" ws %s "}"`, tail(0, true)), nil
+}
+
+// define stores expr under name and returns name.
+func (c *schemaCompiler) define(name, expr string) (string, error) {
+	if _, ok := c.rules[name]; ok {
+		return "", fmt.Errorf("duplicate rule %s", name)
+	}
+	c.rules[name] = expr
+	return name, nil
+}
+
+// orderedKeys returns the keys of a JSON object in document order.
+func orderedKeys(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, errors.New("properties must be an object")
+	}
+	var keys []string
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, t.(string))
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// jsonLiteral returns a GBNF string literal matching the compact encoding
+// of a JSON value.
+func jsonLiteral(raw json.RawMessage) string {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, raw); err != nil {
+		compact.Write(raw)
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(compact.String())
+	return `"` + escaped + `"`
+}
+
+func mustMarshal(v any) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
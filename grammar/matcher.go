@@ -0,0 +1,271 @@
+package grammar
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// maxExpandDepth bounds rule expansion so left-recursive grammars fail
+// instead of looping forever.
+const maxExpandDepth = 256
+
+// position points at the next element to match in one alternative.
+type position struct {
+	rule, alt, idx int
+}
+
+// stack is a parse stack; the last position is matched first. An empty
+// stack means the grammar has been matched completely.
+type stack []position
+
+// Matcher follows a Grammar over a vocabulary of tokens.
+//
+// It keeps the set of parse stacks that are consistent with the text
+// accepted so far, like the sampler grammar in llama.cpp. Tokens are byte
+// strings; a token that ends in the middle of a UTF-8 sequence is allowed
+// if the grammar can accept some character starting with those bytes.
+type Matcher struct {
+	g       *Grammar
+	vocab   [][]byte
+	stacks  []stack
+	partial []byte // leading bytes of an incomplete UTF-8 sequence
+}
+
+// NewMatcher returns a Matcher positioned at the start of g. vocab[i] is
+// the text of token i; nil or empty entries (special tokens) are never
+// allowed.
+func NewMatcher(g *Grammar, vocab [][]byte) (*Matcher, error) {
+	m := &Matcher{g: g, vocab: vocab}
+	stacks, err := g.start()
+	if err != nil {
+		return nil, err
+	}
+	m.stacks = stacks
+	return m, nil
+}
+
+// Allowed reports, for every token of the vocabulary, whether appending it
+// keeps the output a valid prefix of the grammar.
+func (m *Matcher) Allowed() []bool {
+	allowed := make([]bool, len(m.vocab))
+	for i, text := range m.vocab {
+		if len(text) == 0 {
+			continue
+		}
+		stacks, partial, err := m.g.advanceBytes(m.stacks, m.partial, text)
+		allowed[i] = err == nil && (len(stacks) > 0 && m.g.viable(stacks, partial))
+	}
+	return allowed
+}
+
+// CanEnd reports whether the text accepted so far is a complete match.
+func (m *Matcher) CanEnd() bool {
+	if len(m.partial) > 0 {
+		return false
+	}
+	for _, st := range m.stacks {
+		if len(st) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Done reports whether no token can be accepted anymore, so the only
+// valid continuation is to end the output.
+func (m *Matcher) Done() bool {
+	for _, st := range m.stacks {
+		if len(st) > 0 {
+			return false
+		}
+	}
+	return len(m.partial) == 0
+}
+
+// Accept advances the matcher over token.
+func (m *Matcher) Accept(token uint32) error {
+	if int(token) >= len(m.vocab) || len(m.vocab[token]) == 0 {
+		return fmt.Errorf("token %d has no text", token)
+	}
+	stacks, partial, err := m.g.advanceBytes(m.stacks, m.partial, m.vocab[token])
+	if err != nil {
+		return err
+	}
+	if len(stacks) == 0 || !m.g.viable(stacks, partial) {
+		return fmt.Errorf("token %d (%q) is not allowed by the grammar", token, m.vocab[token])
+	}
+	m.stacks, m.partial = stacks, partial
+	return nil
+}
+
+// viable checks that an incomplete UTF-8 sequence can still be completed
+// into a character accepted by one of the stacks.
+func (g *Grammar) viable(stacks []stack, partial []byte) bool {
+	if len(partial) == 0 {
+		return true
+	}
+	lo, hi := runeBounds(partial)
+	for _, st := range stacks {
+		if len(st) == 0 {
+			continue
+		}
+		if g.top(st).mayMatch(lo, hi) {
+			return true
+		}
+	}
+	return false
+}
+
+// runeBounds returns the smallest and largest rune whose encoding starts
+// with the given incomplete UTF-8 prefix.
+func runeBounds(prefix []byte) (rune, rune) {
+	n := utf8SeqLen(prefix[0])
+	lo := append([]byte{}, prefix...)
+	hi := append([]byte{}, prefix...)
+	for len(lo) < n {
+		lo = append(lo, 0x80)
+		hi = append(hi, 0xbf)
+	}
+	l, _ := utf8.DecodeRune(lo)
+	h, _ := utf8.DecodeRune(hi)
+	return l, h
+}
+
+func utf8SeqLen(b byte) int {
+	switch {
+	case b < 0x80:
+		return 1
+	case b>>5 == 0x6:
+		return 2
+	case b>>4 == 0xe:
+		return 3
+	case b>>3 == 0x1e:
+		return 4
+	}
+	return 0
+}
+
+// start returns the stacks at the beginning of the root rule.
+func (g *Grammar) start() ([]stack, error) {
+	e := newExpander(g)
+	for alt := range g.rules[g.root].alts {
+		if err := e.push(stack{}, position{g.root, alt, 0}, 0); err != nil {
+			return nil, err
+		}
+	}
+	return e.out, nil
+}
+
+// advanceBytes feeds text to stacks, carrying an incomplete UTF-8 sequence
+// over from partial and returning the one left at the end.
+func (g *Grammar) advanceBytes(stacks []stack, partial, text []byte) ([]stack, []byte, error) {
+	buf := text
+	if len(partial) > 0 {
+		buf = append(append([]byte{}, partial...), text...)
+	}
+	for len(buf) > 0 && len(stacks) > 0 {
+		if !utf8.FullRune(buf) {
+			if utf8SeqLen(buf[0]) == 0 {
+				return nil, nil, errors.New("invalid UTF-8")
+			}
+			return stacks, append([]byte{}, buf...), nil
+		}
+		r, n := utf8.DecodeRune(buf)
+		if r == utf8.RuneError && n == 1 {
+			return nil, nil, errors.New("invalid UTF-8")
+		}
+		var err error
+		if stacks, err = g.advanceRune(stacks, r); err != nil {
+			return nil, nil, err
+		}
+		buf = buf[n:]
+	}
+	return stacks, nil, nil
+}
+
+// advanceRune returns the stacks reached by matching r.
+func (g *Grammar) advanceRune(stacks []stack, r rune) ([]stack, error) {
+	e := newExpander(g)
+	for _, st := range stacks {
+		if len(st) == 0 || !g.top(st).matches(r) {
+			continue
+		}
+		if err := e.expand(g.step(st), 0); err != nil {
+			return nil, err
+		}
+	}
+	return e.out, nil
+}
+
+// top returns the element the non-empty stack st has to match next.
+func (g *Grammar) top(st stack) element {
+	p := st[len(st)-1]
+	return g.rules[p.rule].alts[p.alt][p.idx]
+}
+
+// step returns st with its top element consumed. Finished alternatives
+// are popped; parents already point past the rule that was entered.
+func (g *Grammar) step(st stack) stack {
+	top := st[len(st)-1]
+	top.idx++
+	next := append(stack{}, st[:len(st)-1]...)
+	if top.idx < len(g.rules[top.rule].alts[top.alt]) {
+		next = append(next, top)
+	}
+	return next
+}
+
+// expander expands stacks until their top is a character element and
+// collects the distinct results.
+type expander struct {
+	g    *Grammar
+	out  []stack
+	seen map[string]bool
+}
+
+func newExpander(g *Grammar) *expander {
+	return &expander{g: g, seen: make(map[string]bool)}
+}
+
+func (e *expander) push(st stack, p position, depth int) error {
+	if p.idx >= len(e.g.rules[p.rule].alts[p.alt]) {
+		// empty alternative
+		return e.expand(st, depth)
+	}
+	return e.expand(append(append(stack{}, st...), p), depth)
+}
+
+func (e *expander) expand(st stack, depth int) error {
+	if depth > maxExpandDepth {
+		return errors.New("grammar expansion too deep, is it left-recursive?")
+	}
+	if len(st) > 0 {
+		if el := e.g.top(st); el.kind == elemRule {
+			rest := e.g.step(st)
+			for alt := range e.g.rules[el.rule].alts {
+				if err := e.push(rest, position{el.rule, alt, 0}, depth+1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	key := st.key()
+	if !e.seen[key] {
+		e.seen[key] = true
+		e.out = append(e.out, st)
+	}
+	return nil
+}
+
+func (st stack) key() string {
+	buf := make([]byte, 0, len(st)*12)
+	for _, p := range st {
+		buf = binary.AppendUvarint(buf, uint64(p.rule))
+		buf = binary.AppendUvarint(buf, uint64(p.alt))
+		buf = binary.AppendUvarint(buf, uint64(p.idx))
+	}
+	return string(buf)
+}
@@ -0,0 +1,327 @@
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"regexp/syntax"
+	"sort"
+	"unicode/utf8"
+)
+
+// maxRegexStates bounds the size of the DFA built by CompileRegex.
+const maxRegexStates = 4096
+
+// Regex is a regular expression compiled into a DFA over the tokens of a
+// vocabulary.
+//
+// The expression must match the whole output, as if it were wrapped in
+// ^(?:...)$. Every DFA state stores the state reached by each token, so a
+// generation step only has to look up one row. Tokens that lead to states
+// from which no match can be completed are not allowed.
+//
+// A Regex is immutable and can be shared; use Matcher to follow one
+// output.
+type Regex struct {
+	vocab  [][]byte
+	prog   *syntax.Prog
+	states []*regexState
+	index  map[string]int
+}
+
+// regexState is a DFA state: the NFA threads waiting for a character,
+// plus the leading bytes of a character split between tokens.
+type regexState struct {
+	pcs     []uint32
+	partial []byte
+	accept  bool
+	next    []int32 // next[token] is the following state, -1 if not allowed
+}
+
+// CompileRegex compiles expr (Go regexp syntax) against vocab, where
+// vocab[i] is the text of token i and nil entries are never allowed.
+// Word boundaries are not supported.
+func CompileRegex(expr string, vocab [][]byte) (*Regex, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, err
+	}
+	for _, inst := range prog.Inst {
+		if inst.Op == syntax.InstEmptyWidth && syntax.EmptyOp(inst.Arg)&(syntax.EmptyWordBoundary|syntax.EmptyNoWordBoundary) != 0 {
+			return nil, errors.New("word boundaries are not supported")
+		}
+	}
+
+	r := &Regex{vocab: vocab, prog: prog, index: make(map[string]int)}
+	start := r.closure([]uint32{uint32(prog.Start)}, true)
+	r.state(start, nil)
+	for i := 0; i < len(r.states); i++ {
+		if len(r.states) > maxRegexStates {
+			return nil, fmt.Errorf("regex needs more than %d DFA states", maxRegexStates)
+		}
+		r.expand(r.states[i])
+	}
+	r.prune()
+	return r, nil
+}
+
+// Matcher returns a matcher positioned at the start of the expression.
+func (r *Regex) Matcher() *RegexMatcher {
+	return &RegexMatcher{re: r}
+}
+
+// RegexMatcher follows a Regex token by token. It implements the same
+// methods as Matcher.
+type RegexMatcher struct {
+	re    *Regex
+	state int
+}
+
+// Allowed reports, for every token of the vocabulary, whether appending it
+// keeps the output a prefix of a match.
+func (m *RegexMatcher) Allowed() []bool {
+	next := m.re.states[m.state].next
+	allowed := make([]bool, len(next))
+	for i, s := range next {
+		allowed[i] = s >= 0
+	}
+	return allowed
+}
+
+// CanEnd reports whether the output accepted so far is a complete match.
+func (m *RegexMatcher) CanEnd() bool {
+	return m.re.states[m.state].accept
+}
+
+// Done reports whether no token can be accepted anymore.
+func (m *RegexMatcher) Done() bool {
+	for _, s := range m.re.states[m.state].next {
+		if s >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Accept advances the matcher over token.
+func (m *RegexMatcher) Accept(token uint32) error {
+	next := m.re.states[m.state].next
+	if int(token) >= len(next) || next[token] < 0 {
+		return fmt.Errorf("token %d is not allowed by the regex", token)
+	}
+	m.state = int(next[token])
+	return nil
+}
+
+// state returns the id of the state with the given threads, adding it if
+// it is new.
+func (r *Regex) state(pcs []uint32, partial []byte) int {
+	key := stateKey(pcs, partial)
+	if id, ok := r.index[key]; ok {
+		return id
+	}
+	s := &regexState{pcs: pcs, partial: partial, accept: len(partial) == 0 && r.accepts(pcs)}
+	r.index[key] = len(r.states)
+	r.states = append(r.states, s)
+	return len(r.states) - 1
+}
+
+func stateKey(pcs []uint32, partial []byte) string {
+	buf := make([]byte, 0, len(pcs)*4+len(partial)+1)
+	for _, pc := range pcs {
+		buf = append(buf, byte(pc>>24), byte(pc>>16), byte(pc>>8), byte(pc))
+	}
+	buf = append(buf, 0xff) // no UTF-8 byte, separates the partial sequence
+	return string(append(buf, partial...))
+}
+
+// expand fills in the token transitions of s.
+func (r *Regex) expand(s *regexState) {
+	s.next = make([]int32, len(r.vocab))
+	for id, text := range r.vocab {
+		s.next[id] = -1
+		if len(text) == 0 {
+			continue
+		}
+		pcs, partial, ok := r.advance(s.pcs, append(append([]byte{}, s.partial...), text...))
+		if ok {
+			s.next[id] = int32(r.state(pcs, partial))
+		}
+	}
+}
+
+// advance runs the threads over buf and returns the threads and the
+// incomplete character left at the end.
+func (r *Regex) advance(pcs []uint32, buf []byte) ([]uint32, []byte, bool) {
+	for len(buf) > 0 {
+		if len(pcs) == 0 {
+			return nil, nil, false
+		}
+		if !utf8.FullRune(buf) {
+			if utf8SeqLen(buf[0]) == 0 || !r.mayMatch(pcs, buf) {
+				return nil, nil, false
+			}
+			return pcs, buf, true
+		}
+		c, n := utf8.DecodeRune(buf)
+		if c == utf8.RuneError && n == 1 {
+			return nil, nil, false
+		}
+		var next []uint32
+		for _, pc := range pcs {
+			if matchRune(r.prog.Inst[pc], c) {
+				next = append(next, r.prog.Inst[pc].Out)
+			}
+		}
+		pcs = r.closure(next, false)
+		buf = buf[n:]
+	}
+	return pcs, nil, len(pcs) > 0
+}
+
+// matchRune reports whether inst consumes c. Other instructions never do.
+func matchRune(inst syntax.Inst, c rune) bool {
+	switch inst.Op {
+	case syntax.InstRune1:
+		return c == inst.Rune[0]
+	case syntax.InstRuneAny:
+		return true
+	case syntax.InstRuneAnyNotNL:
+		return c != '\n'
+	case syntax.InstRune:
+		return inst.MatchRune(c)
+	}
+	return false
+}
+
+// closure follows the empty transitions from pcs and returns the sorted
+// threads waiting for a character. A match instruction is kept as a
+// thread so accepting states stay distinct.
+func (r *Regex) closure(pcs []uint32, atStart bool) []uint32 {
+	seen := make(map[uint32]bool)
+	var out []uint32
+	var visit func(pc uint32)
+	visit = func(pc uint32) {
+		if seen[pc] {
+			return
+		}
+		seen[pc] = true
+		inst := r.prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			visit(inst.Out)
+			visit(inst.Arg)
+		case syntax.InstCapture, syntax.InstNop:
+			visit(inst.Out)
+		case syntax.InstEmptyWidth:
+			op := syntax.EmptyOp(inst.Arg)
+			if op&(syntax.EmptyBeginText|syntax.EmptyBeginLine) != 0 && !atStart {
+				return
+			}
+			if op&(syntax.EmptyEndText|syntax.EmptyEndLine) != 0 {
+				// only satisfied at the end, resolved by accepts
+				out = append(out, pc)
+				return
+			}
+			visit(inst.Out)
+		case syntax.InstMatch, syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			out = append(out, pc)
+		}
+	}
+	for _, pc := range pcs {
+		visit(pc)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a] < out[b] })
+	return out
+}
+
+// accepts reports whether the threads can match at the end of the text.
+func (r *Regex) accepts(pcs []uint32) bool {
+	seen := make(map[uint32]bool)
+	var visit func(pc uint32) bool
+	visit = func(pc uint32) bool {
+		if seen[pc] {
+			return false
+		}
+		seen[pc] = true
+		inst := r.prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstMatch:
+			return true
+		case syntax.InstAlt, syntax.InstAltMatch:
+			return visit(inst.Out) || visit(inst.Arg)
+		case syntax.InstCapture, syntax.InstNop, syntax.InstEmptyWidth:
+			return visit(inst.Out)
+		}
+		return false
+	}
+	for _, pc := range pcs {
+		if visit(pc) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayMatch reports whether some thread accepts a character starting with
+// the incomplete UTF-8 sequence prefix.
+func (r *Regex) mayMatch(pcs []uint32, prefix []byte) bool {
+	lo, hi := runeBounds(prefix)
+	for _, pc := range pcs {
+		inst := r.prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			return true
+		case syntax.InstRune1:
+			if inst.Rune[0] >= lo && inst.Rune[0] <= hi {
+				return true
+			}
+		case syntax.InstRune:
+			if syntax.Flags(inst.Arg)&syntax.FoldCase != 0 {
+				return true
+			}
+			for i := 0; i+1 < len(inst.Rune); i += 2 {
+				if inst.Rune[i] <= hi && inst.Rune[i+1] >= lo {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// prune disallows tokens leading to states from which no accepting state
+// can be reached.
+func (r *Regex) prune() {
+	live := make([]bool, len(r.states))
+	for changed := true; changed; {
+		changed = false
+		for i, s := range r.states {
+			if live[i] {
+				continue
+			}
+			if s.accept {
+				live[i] = true
+				changed = true
+				continue
+			}
+			for _, next := range s.next {
+				if next >= 0 && live[next] {
+					live[i] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	for _, s := range r.states {
+		for id, next := range s.next {
+			if next >= 0 && !live[next] {
+				s.next[id] = -1
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package grammar
+
+import (
+	"testing"
+)
+
+// regexMatches reports whether text is accepted completely by re.
+func regexMatches(t *testing.T, re *Regex, vocab [][]byte, text string) bool {
+	t.Helper()
+	m := re.Matcher()
+	for _, id := range tokenize(t, vocab, text) {
+		allowed := m.Allowed()[id]
+		err := m.Accept(id)
+		if allowed != (err == nil) {
+			t.Fatalf("Allowed and Accept disagree on %q in %q", vocab[id], text)
+		}
+		if err != nil {
+			return false
+		}
+	}
+	return m.CanEnd()
+}
+
+func TestCompileRegex(t *testing.T) {
+	vocab := testVocab()
+	for _, tc := range []struct {
+		expr    string
+		text    string
+		matches bool
+	}{
+		{`[a-z]+@[a-z]+\.com`, "tom@mail.com", true},
+		{`[a-z]+@[a-z]+\.com`, "tom@mail.co", false},
+		{`[a-z]+@[a-z]+\.com`, "x tom@mail.com", false},
+		{`(true|false)!?`, "true", true},
+		{`(true|false)!?`, "false!", true},
+		{`(true|false)!?`, "tru", false},
+		{`\d{3}-\d{4}`, "555-1234", true},
+		{`\d{3}-\d{4}`, "555-12345", false},
+		{`^(?i)hello$`, "HeLLo", true},
+		{`caf.`, "café", true},
+		{`caf[^é]`, "café", false},
+		{`a.c`, "a\nc", false},
+		{`(?s)a.c`, "a\nc", true},
+	} {
+		re, err := CompileRegex(tc.expr, vocab)
+		if err != nil {
+			t.Fatalf("CompileRegex(%q) failed: %v", tc.expr, err)
+		}
+		if actual := regexMatches(t, re, vocab, tc.text); actual != tc.matches {
+			t.Errorf("%q on %q = %v, expected %v", tc.expr, tc.text, actual, tc.matches)
+		}
+	}
+
+	if _, err := CompileRegex(`\bword`, vocab); err == nil {
+		t.Errorf("Word boundaries should be rejected")
+	}
+	if _, err := CompileRegex(`(`, vocab); err == nil {
+		t.Errorf("Invalid expressions should be rejected")
+	}
+}
+
+func TestRegexPrunesDeadEnds(t *testing.T) {
+	// there is no "c" token, so no match can ever be completed
+	vocab := [][]byte{[]byte("a"), []byte("b"), []byte("ab")}
+	re, err := CompileRegex(`a(b|c)c`, vocab)
+	if err != nil {
+		t.Fatalf("CompileRegex failed: %v", err)
+	}
+	m := re.Matcher()
+	if allowed := m.Allowed(); allowed[0] || allowed[1] || allowed[2] {
+		t.Errorf("No token can lead to a match, got %v", allowed)
+	}
+
+	re, err = CompileRegex(`a(b|c)`, vocab)
+	if err != nil {
+		t.Fatalf("CompileRegex failed: %v", err)
+	}
+	m = re.Matcher()
+	if allowed := m.Allowed(); !allowed[0] || allowed[1] || !allowed[2] {
+		t.Errorf("Unexpected allowed tokens %v", allowed)
+	}
+	if err := m.Accept(2); err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	if !m.CanEnd() || !m.Done() {
+		t.Errorf("Matcher should be done after %q", "ab")
+	}
+}
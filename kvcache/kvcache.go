@@ -83,6 +83,44 @@ func (kc *KVCache[T]) Increment(seqLen uint32) error {
 	return nil
 }
 
+// Truncate rolls the cache back to the first seqLen positions, discarding
+// the keys and values after them
+func (kc *KVCache[T]) Truncate(seqLen uint32) error {
+	if seqLen > kc.length {
+		return errors.New("truncate length exceeds current length")
+	}
+
+	kc.length = seqLen
+	return nil
+}
+
+// Clone returns an independent copy of the cache. The copy has the same
+// capacity and holds the same keys and values up to the current length, so a
+// sequence can be forked without recomputing its prefix.
+func (kc *KVCache[T]) Clone() *KVCache[T] {
+	kCache := make([]*tensor.Tensor[T], len(kc.kCache))
+	vCache := make([]*tensor.Tensor[T], len(kc.vCache))
+	used := kc.length * kc.dim
+
+	for i := range kc.kCache {
+		kTensor := tensor.EmptyTensor[T]([]uint32{kc.maxSeqLen, kc.dim})
+		vTensor := tensor.EmptyTensor[T]([]uint32{kc.maxSeqLen, kc.dim})
+		copy(kTensor.Data()[:used], kc.kCache[i].Data()[:used])
+		copy(vTensor.Data()[:used], kc.vCache[i].Data()[:used])
+
+		kCache[i] = kTensor
+		vCache[i] = vTensor
+	}
+
+	return &KVCache[T]{
+		kCache:    kCache,
+		vCache:    vCache,
+		maxSeqLen: kc.maxSeqLen,
+		dim:       kc.dim,
+		length:    kc.length,
+	}
+}
+
 // Len returns the current length of the sequence in the cache
 func (kc *KVCache[T]) Len() uint32 {
 	return kc.length
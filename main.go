@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"learning-lm-go/model"
+	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	nested "github.com/antonfisher/nested-logrus-formatter"
 	"github.com/daulet/tokenizers"
@@ -33,6 +38,11 @@ func SetUpLogger() {
 
 func main() {
 	SetUpLogger()
+	if len(os.Args) > 1 && os.Args[1] == "perplexity" {
+		runPerplexity(os.Args[2:])
+		return
+	}
+
 	model_dir := "models/story"
 	llama, err := model.FromSafeTensors(model_dir)
 	if err != nil {
@@ -49,12 +59,36 @@ func main() {
 	input_tokens, _ := tk.Encode("<|start_story|>Bluey", false)
 	logrus.Info("Input tokens: ", input_tokens)
 
-	output_tokens, err := llama.Generate(input_tokens, 300, 0.9, 40, 0.6)
-	if err != nil {
+	// Ctrl-C stops generation and keeps what has been produced so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	result, err := llama.GenerateStream(ctx, input_tokens, model.GenerateConfig{
+		MaxLen: 300,
+		Sampling: model.SamplingParams{
+			Temperature: 0.6,
+			TopK:        40,
+			TopP:        0.9,
+			Seed:        time.Now().UnixNano(),
+
+			RepetitionPenalty: 1.1,
+			PenaltyWindow:     64,
+		},
+		Decoder: tk,
+	}, func(tok model.GeneratedToken) error {
+		fmt.Print(tok.Text)
+		return nil
+	})
+	fmt.Println()
+	var canceled *model.CanceledError
+	if errors.As(err, &canceled) {
+		logrus.Warn("Generation interrupted: ", err)
+	} else if err != nil {
 		logrus.Fatal("Faile to generate tokens: ", err)
 		panic("Generating tokens failed")
 	}
-	logrus.Info("Output tokens: ", output_tokens)
-	output_text := tk.Decode(output_tokens, false)
+	logrus.Info("Output tokens: ", result.Tokens)
+	logrus.Info("Finish reason: ", result.FinishReason)
+	output_text := tk.Decode(result.Tokens, false)
 	logrus.Info("Output text: ", output_text)
 }
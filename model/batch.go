@@ -0,0 +1,172 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"learning-lm-go/kvcache"
+	"learning-lm-go/tensor"
+)
+
+// BatchStreamFunc receives every token generated by GenerateBatch or
+// GenerateN; seq is the index of the sequence it continues. Returning
+// ErrStopGeneration stops that sequence only.
+type BatchStreamFunc func(seq int, tok GeneratedToken) error
+
+// GenerateBatch continues several prompts together. cfgs holds one
+// configuration per prompt, or a single one shared by all of them; each
+// sequence still gets its own sampler, seeded from its configuration,
+// and its own stop conditions.
+//
+// Every decode step runs one forward pass over all unfinished sequences,
+// so the matrix multiplications are shared by the batch while attention
+// uses each sequence's own KV cache. Prompts may have different lengths;
+// finished sequences drop out of the batch. fn may be nil.
+func (l *Llama) GenerateBatch(ctx context.Context, prompts [][]uint32, cfgs []GenerateConfig, fn BatchStreamFunc) ([]*GenerateResult, error) {
+	if len(cfgs) != 1 && len(cfgs) != len(prompts) {
+		return nil, fmt.Errorf("got %d configurations for %d prompts", len(cfgs), len(prompts))
+	}
+	seqs := make([]*sequence, len(prompts))
+	for i, prompt := range prompts {
+		cfg := cfgs[0]
+		if len(cfgs) > 1 {
+			cfg = cfgs[i]
+		} else if len(prompts) > 1 && (cfg.Constraint != nil || cfg.Sampler != nil) {
+			return nil, errors.New("a shared configuration cannot hold a Constraint or Sampler, they are stateful")
+		}
+		cache, err := l.NewCache()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cache: %v", err)
+		}
+		if seqs[i], err = l.newSequence(prompt, cfg, cache); err != nil {
+			return nil, fmt.Errorf("prompt %d: %v", i, err)
+		}
+	}
+	return l.decodeBatch(ctx, seqs, fn)
+}
+
+// GenerateN draws n samples continuing the same prompt, for
+// self-consistency voting or best-of-n reranking.
+//
+// The prompt is prefilled once; its KV cache is then cloned for every
+// sample and the samples are decoded as a batch, see GenerateBatch.
+// Sample i uses cfg.Sampling.Seed+i, so the samples differ but the whole
+// set is reproducible. cfg cannot hold a Constraint or Sampler when n > 1.
+func (l *Llama) GenerateN(ctx context.Context, tokens []uint32, cfg GenerateConfig, n int, fn BatchStreamFunc) ([]*GenerateResult, error) {
+	if n <= 0 {
+		return nil, errors.New("n must be positive")
+	}
+	if n > 1 && (cfg.Constraint != nil || cfg.Sampler != nil) {
+		return nil, errors.New("a Constraint or Sampler cannot be shared between samples, they are stateful")
+	}
+	cache, err := l.NewCache()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache: %v", err)
+	}
+	seqs := make([]*sequence, n)
+	for i := range seqs {
+		c := cfg
+		c.Sampling.Seed += int64(i)
+		if seqs[i], err = l.newSequence(tokens, c, cache); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return failBatch(ctx, seqs, err)
+	}
+	first := seqs[0]
+	if err := first.fit(); err != nil {
+		return results(seqs), err
+	}
+	// advance replaces the pending tokens, keep the fitted prompt for the
+	// other samples
+	prompt := first.pending
+	input := tensor.NewTensor(prompt, []uint32{uint32(len(prompt))})
+	logits, err := l.forward(ctx, input, cache, first.allPositions())
+	if err != nil {
+		return failBatch(ctx, seqs, err)
+	}
+	for i, seq := range seqs {
+		if i > 0 {
+			seq.cache = cache.Clone()
+			seq.pending = prompt
+		}
+		// the processors rewrite the logits, every sample needs its own copy
+		own := tensor.NewTensor(append([]float32(nil), logits.Data()...), logits.Shape())
+		if err := seq.advance(own, seqStream(fn, i)); err != nil {
+			return results(seqs), err
+		}
+	}
+	return l.decodeBatch(ctx, seqs, fn)
+}
+
+// decodeBatch runs the decode loop of several sequences until all of them
+// are finished.
+func (l *Llama) decodeBatch(ctx context.Context, seqs []*sequence, fn BatchStreamFunc) ([]*GenerateResult, error) {
+	for {
+		var active []int
+		for i, seq := range seqs {
+			if !seq.done() {
+				active = append(active, i)
+			}
+		}
+		if len(active) == 0 {
+			return results(seqs), nil
+		}
+		if err := ctx.Err(); err != nil {
+			return failBatch(ctx, seqs, err)
+		}
+
+		for _, i := range active {
+			if err := seqs[i].fit(); err != nil {
+				return results(seqs), err
+			}
+		}
+
+		inputs := make([][]uint32, len(active))
+		caches := make([]*kvcache.KVCache[float32], len(active))
+		allPositions := make([]bool, len(active))
+		for j, i := range active {
+			inputs[j] = seqs[i].pending
+			caches[j] = seqs[i].cache
+			allPositions[j] = seqs[i].allPositions()
+		}
+		logits, err := l.forwardBatch(ctx, inputs, caches, allPositions)
+		if err != nil {
+			return failBatch(ctx, seqs, err)
+		}
+
+		for j, i := range active {
+			if err := seqs[i].advance(logits[j], seqStream(fn, i)); err != nil {
+				return results(seqs), err
+			}
+		}
+	}
+}
+
+// seqStream adapts fn to the StreamFunc of sequence i.
+func seqStream(fn BatchStreamFunc, i int) StreamFunc {
+	if fn == nil {
+		return nil
+	}
+	return func(tok GeneratedToken) error { return fn(i, tok) }
+}
+
+func results(seqs []*sequence) []*GenerateResult {
+	out := make([]*GenerateResult, len(seqs))
+	for i, seq := range seqs {
+		out[i] = seq.result
+	}
+	return out
+}
+
+// failBatch ends the unfinished sequences with err, see GenerateResult.fail.
+func failBatch(ctx context.Context, seqs []*sequence, err error) ([]*GenerateResult, error) {
+	for _, seq := range seqs {
+		if !seq.done() {
+			_, err = seq.result.fail(ctx, err)
+		}
+	}
+	return results(seqs), err
+}
@@ -0,0 +1,152 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"learning-lm-go/kvcache"
+	"learning-lm-go/tensor"
+	"reflect"
+	"testing"
+)
+
+func TestForwardBatch(t *testing.T) {
+	model := loadStoryModel(t)
+	inputs := [][]uint32{{1, 400, 500}, {1, 23}, {1, 97, 88, 1024, 5}}
+	vocab := uint32(model.Config.Vocab)
+
+	caches := make([]*kvcache.KVCache[float32], len(inputs))
+	for i := range caches {
+		caches[i], _ = model.NewCache()
+	}
+	batch, err := model.forwardBatch(context.Background(), inputs, caches, []bool{false, true, false})
+	if err != nil {
+		t.Fatalf("forwardBatch failed: %v", err)
+	}
+	for i, input := range inputs {
+		cache, _ := model.NewCache()
+		single, err := model.ForwardAll(tensor.NewTensor(input, []uint32{uint32(len(input))}), cache)
+		if err != nil {
+			t.Fatalf("ForwardAll failed: %v", err)
+		}
+		if i != 1 {
+			single = single.Slice(uint32(len(input)-1)*vocab, []uint32{1, vocab})
+		}
+		if ok, err := batch[i].CloseTo(single, 1e-4); err != nil || !ok {
+			t.Errorf("Logits of sequence %d differ from a single forward pass (%v)", i, err)
+		}
+		if caches[i].Len() != uint32(len(input)) {
+			t.Errorf("Cache %d holds %d tokens, expected %d", i, caches[i].Len(), len(input))
+		}
+	}
+}
+
+func TestGenerateBatch(t *testing.T) {
+	model := loadStoryModel(t)
+	prompts := [][]uint32{{1, 400, 500}, {1, 23}, {1, 97, 88, 1024, 5}}
+	cfgs := []GenerateConfig{
+		{MaxLen: 30},
+		{MaxLen: 20, Sampling: SamplingParams{Temperature: 0.8, TopK: 40, Seed: 3}},
+		{MaxLen: 25, Sampling: SamplingParams{Temperature: 1.2, TopP: 0.9, Seed: 4}, StopTokens: []uint32{10}, TopLogprobs: 2, Echo: true},
+	}
+
+	streamed := make([][]uint32, len(prompts))
+	results, err := model.GenerateBatch(context.Background(), prompts, cfgs, func(seq int, tok GeneratedToken) error {
+		streamed[seq] = append(streamed[seq], tok.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("GenerateBatch failed: %v", err)
+	}
+	for i, prompt := range prompts {
+		expected, err := model.GenerateContext(context.Background(), prompt, cfgs[i])
+		if err != nil {
+			t.Fatalf("GenerateContext failed: %v", err)
+		}
+		if !reflect.DeepEqual(results[i].Tokens, expected.Tokens) || results[i].FinishReason != expected.FinishReason {
+			t.Errorf("Sequence %d differs from single generation:\n%v %s\n%v %s", i,
+				results[i].Tokens, results[i].FinishReason, expected.Tokens, expected.FinishReason)
+		}
+		if !reflect.DeepEqual(streamed[i], results[i].Tokens[len(prompt):]) {
+			t.Errorf("Sequence %d streamed %v", i, streamed[i])
+		}
+		if len(results[i].PromptLogprobs) != len(expected.PromptLogprobs) {
+			t.Errorf("Sequence %d has %d prompt logprobs, expected %d", i, len(results[i].PromptLogprobs), len(expected.PromptLogprobs))
+		}
+	}
+
+	// one shared configuration, and stopping a single sequence early
+	results, err = model.GenerateBatch(context.Background(), prompts, []GenerateConfig{{MaxLen: 30}}, func(seq int, tok GeneratedToken) error {
+		if seq == 0 {
+			return ErrStopGeneration
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("GenerateBatch failed: %v", err)
+	}
+	if len(results[0].Tokens) != len(prompts[0])+1 || results[0].FinishReason != FinishCanceled {
+		t.Errorf("Sequence 0 should stop after one token, got %v (%s)", results[0].Tokens, results[0].FinishReason)
+	}
+	if results[1].FinishReason == FinishCanceled {
+		t.Errorf("Stopping sequence 0 must not stop sequence 1")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = model.GenerateBatch(ctx, prompts, []GenerateConfig{{MaxLen: 30}}, nil)
+	var canceled *CanceledError
+	if !errors.As(err, &canceled) {
+		t.Errorf("Expected a CanceledError, got %v", err)
+	}
+	if _, err := model.GenerateBatch(context.Background(), prompts, cfgs[:2], nil); err == nil {
+		t.Errorf("Mismatched configurations should be rejected")
+	}
+}
+
+func TestGenerateN(t *testing.T) {
+	model := loadStoryModel(t)
+	prompt := []uint32{1, 400, 500}
+	cfg := GenerateConfig{MaxLen: 24, Sampling: SamplingParams{Temperature: 1.0, TopK: 50, Seed: 7}}
+
+	results, err := model.GenerateN(context.Background(), prompt, cfg, 4, nil)
+	if err != nil {
+		t.Fatalf("GenerateN failed: %v", err)
+	}
+	distinct := map[string]bool{}
+	for i, result := range results {
+		single := cfg
+		single.Sampling.Seed += int64(i)
+		expected, err := model.GenerateContext(context.Background(), prompt, single)
+		if err != nil {
+			t.Fatalf("GenerateContext failed: %v", err)
+		}
+		if !reflect.DeepEqual(result.Tokens, expected.Tokens) {
+			t.Errorf("Sample %d differs from generating with seed %d:\n%v\n%v", i, single.Sampling.Seed, result.Tokens, expected.Tokens)
+		}
+		distinct[fmt.Sprint(result.Tokens)] = true
+	}
+	if len(distinct) < 2 {
+		t.Errorf("All samples are identical: %v", results[0].Tokens)
+	}
+
+	// every sample scores the whole prompt when it is echoed
+	echo := GenerateConfig{MaxLen: 8, Echo: true, Sampling: SamplingParams{Temperature: 1, Seed: 2}}
+	long := []uint32{1, 400, 500, 600}
+	results, err = model.GenerateN(context.Background(), long, echo, 2, nil)
+	if err != nil {
+		t.Fatalf("GenerateN with echo failed: %v", err)
+	}
+	for i, result := range results {
+		single := echo
+		single.Sampling.Seed += int64(i)
+		expected, _ := model.GenerateContext(context.Background(), long, single)
+		if !reflect.DeepEqual(result.Tokens, expected.Tokens) || !reflect.DeepEqual(result.PromptLogprobs, expected.PromptLogprobs) {
+			t.Errorf("Echoed sample %d differs from single generation", i)
+		}
+	}
+
+	if _, err := model.GenerateN(context.Background(), prompt, cfg, 0, nil); err == nil {
+		t.Errorf("n = 0 should be rejected")
+	}
+}
@@ -0,0 +1,222 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"learning-lm-go/kvcache"
+	"learning-lm-go/tensor"
+	"math"
+	"sort"
+)
+
+// BeamSearchConfig describes a beam search request.
+type BeamSearchConfig struct {
+	MaxLen   uint32 // maximum sequence length, prompt included
+	NumBeams int    // beam width
+
+	// LengthPenalty is the exponent applied to the number of generated
+	// tokens when ranking hypotheses: score = logprob / len^LengthPenalty.
+	// 0 ranks by total logprob, values above 0 favour longer outputs.
+	LengthPenalty float32
+	// EarlyStopping ends the search as soon as NumBeams hypotheses are
+	// finished. Otherwise the search goes on while a live beam can still
+	// beat the worst finished hypothesis.
+	EarlyStopping bool
+	// NumReturn is the number of hypotheses returned, at most NumBeams.
+	// 0 returns only the best one.
+	NumReturn int
+}
+
+// Beam is a hypothesis produced by beam search.
+type Beam struct {
+	Tokens       []uint32 // the prompt followed by the generated tokens
+	Logprob      float32  // summed logprob of the generated tokens
+	Score        float32  // Logprob after the length penalty, used for ranking
+	FinishReason FinishReason
+}
+
+// liveBeam is a beam still being extended. Each one owns its KV cache.
+type liveBeam struct {
+	tokens  []uint32
+	logprob float64
+	cache   *kvcache.KVCache[float32]
+	logits  *Tensor[float32]
+}
+
+// beamCandidate is a one-token extension of a live beam.
+type beamCandidate struct {
+	parent  int
+	token   uint32
+	logprob float64
+}
+
+// BeamSearch decodes tokens with beam search and returns the best
+// hypotheses, best first.
+//
+// The prompt is prefilled once. When a beam is extended by several
+// candidates the first one takes over its KV cache and the others get a
+// clone, so the prefix is never recomputed. Beams that are not extended
+// are pruned together with their caches.
+func (l *Llama) BeamSearch(ctx context.Context, tokens []uint32, cfg BeamSearchConfig) ([]Beam, error) {
+	if cfg.NumBeams <= 0 {
+		return nil, errors.New("beam search needs at least one beam")
+	}
+	numReturn := cfg.NumReturn
+	if numReturn <= 0 {
+		numReturn = 1
+	}
+	if numReturn > cfg.NumBeams {
+		return nil, fmt.Errorf("cannot return %d beams with a beam width of %d", numReturn, cfg.NumBeams)
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("beam search needs a non-empty prompt")
+	}
+
+	cache, err := l.NewCache()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache: %v", err)
+	}
+	logits, err := l.ForwardContext(ctx, tensor.NewTensor(tokens, []uint32{uint32(len(tokens))}), cache)
+	if err != nil {
+		return nil, ctxError(ctx, err)
+	}
+
+	promptLen := len(tokens)
+	live := []*liveBeam{{tokens: append([]uint32(nil), tokens...), cache: cache, logits: logits}}
+	finished := &beamHypotheses{size: cfg.NumBeams, lengthPenalty: cfg.LengthPenalty, promptLen: promptLen}
+
+	for len(live) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, &CanceledError{Err: err}
+		}
+
+		candidates := l.beamCandidates(live, 2*cfg.NumBeams)
+		next := make([]*liveBeam, 0, cfg.NumBeams)
+		taken := make([]bool, len(live))
+		for rank, c := range candidates {
+			if len(next) == cfg.NumBeams {
+				break
+			}
+			parent := live[c.parent]
+			seq := append(append([]uint32(nil), parent.tokens...), c.token)
+			if c.token == l.Config.EosTokenID {
+				// only hypotheses that would have made the beam are kept
+				if rank < cfg.NumBeams {
+					finished.add(seq, c.logprob, FinishEOS)
+				}
+				continue
+			}
+			// forwards only run once all beams are picked, so the parent's
+			// cache still holds just the shared prefix when it is cloned
+			beam := &liveBeam{tokens: seq, logprob: c.logprob, cache: parent.cache}
+			if taken[c.parent] {
+				beam.cache = parent.cache.Clone()
+			}
+			taken[c.parent] = true
+			next = append(next, beam)
+		}
+
+		live = live[:0]
+		for _, beam := range next {
+			if uint32(len(beam.tokens)) >= cfg.MaxLen {
+				finished.add(beam.tokens, beam.logprob, FinishLength)
+				continue
+			}
+			last := beam.tokens[len(beam.tokens)-1:]
+			beam.logits, err = l.ForwardContext(ctx, tensor.NewTensor(last, []uint32{1}), beam.cache)
+			if err != nil {
+				return nil, ctxError(ctx, err)
+			}
+			live = append(live, beam)
+		}
+
+		if finished.done(live, cfg.EarlyStopping) {
+			break
+		}
+	}
+
+	return finished.best(numReturn), nil
+}
+
+// beamCandidates returns the best k extensions of every live beam, ranked
+// by cumulative logprob.
+func (l *Llama) beamCandidates(live []*liveBeam, k int) []beamCandidate {
+	var candidates []beamCandidate
+	for i, beam := range live {
+		lp := newLogprobs(beam.logits.Data())
+		for _, top := range lp.Top(k) {
+			candidates = append(candidates, beamCandidate{
+				parent:  i,
+				token:   top.ID,
+				logprob: beam.logprob + float64(top.Logprob),
+			})
+		}
+	}
+	sort.SliceStable(candidates, func(a, b int) bool {
+		return candidates[a].logprob > candidates[b].logprob
+	})
+	return candidates
+}
+
+// ctxError turns an error caused by ctx into a *CanceledError.
+func ctxError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return &CanceledError{Err: ctx.Err()}
+	}
+	return err
+}
+
+// beamHypotheses keeps the best finished hypotheses.
+type beamHypotheses struct {
+	size          int
+	lengthPenalty float32
+	promptLen     int
+	beams         []Beam
+}
+
+func (h *beamHypotheses) score(logprob float64, length int) float64 {
+	generated := length - h.promptLen
+	if h.lengthPenalty == 0 || generated <= 0 {
+		return logprob
+	}
+	return logprob / math.Pow(float64(generated), float64(h.lengthPenalty))
+}
+
+func (h *beamHypotheses) add(tokens []uint32, logprob float64, reason FinishReason) {
+	h.beams = append(h.beams, Beam{
+		Tokens:       tokens,
+		Logprob:      float32(logprob),
+		Score:        float32(h.score(logprob, len(tokens))),
+		FinishReason: reason,
+	})
+	sort.SliceStable(h.beams, func(a, b int) bool {
+		return h.beams[a].Score > h.beams[b].Score
+	})
+	if len(h.beams) > h.size {
+		h.beams = h.beams[:h.size]
+	}
+}
+
+// done reports whether the search can stop. Without early stopping the
+// best live beam is scored at its current length, which is exact for a
+// length penalty of 0 and the usual heuristic otherwise.
+func (h *beamHypotheses) done(live []*liveBeam, earlyStopping bool) bool {
+	if len(h.beams) < h.size {
+		return false
+	}
+	if earlyStopping || len(live) == 0 {
+		return true
+	}
+	worst := float64(h.beams[len(h.beams)-1].Score)
+	for _, beam := range live {
+		if h.score(beam.logprob, len(beam.tokens)) > worst {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *beamHypotheses) best(n int) []Beam {
+	return h.beams[:min(n, len(h.beams))]
+}
@@ -0,0 +1,77 @@
+package model
+
+import (
+	"context"
+	"learning-lm-go/tensor"
+	"reflect"
+	"testing"
+)
+
+func TestBeamSearchWidthOneIsGreedy(t *testing.T) {
+	model := loadStoryModel(t)
+	prompt := []uint32{1, 400, 500}
+
+	greedy, err := model.GenerateContext(context.Background(), prompt, GenerateConfig{MaxLen: 20})
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	beams, err := model.BeamSearch(context.Background(), prompt, BeamSearchConfig{MaxLen: 20, NumBeams: 1})
+	if err != nil {
+		t.Fatalf("BeamSearch failed: %v", err)
+	}
+	if len(beams) != 1 || !reflect.DeepEqual(beams[0].Tokens, greedy.Tokens) {
+		t.Errorf("Width 1 beam search should match greedy decoding: %v vs %v", beams, greedy.Tokens)
+	}
+}
+
+func TestBeamSearchNBest(t *testing.T) {
+	model := loadStoryModel(t)
+	prompt := []uint32{1, 400, 500}
+
+	beams, err := model.BeamSearch(context.Background(), prompt, BeamSearchConfig{
+		MaxLen:        16,
+		NumBeams:      4,
+		NumReturn:     3,
+		LengthPenalty: 1,
+	})
+	if err != nil {
+		t.Fatalf("BeamSearch failed: %v", err)
+	}
+	if len(beams) != 3 {
+		t.Fatalf("Expected 3 beams, got %d", len(beams))
+	}
+	for i, beam := range beams {
+		if i > 0 && beam.Score > beams[i-1].Score {
+			t.Errorf("Beams are not sorted by score: %v", beams)
+		}
+		if i > 0 && reflect.DeepEqual(beam.Tokens, beams[i-1].Tokens) {
+			t.Errorf("Beams %d and %d are identical", i-1, i)
+		}
+
+		// rescoring from scratch checks that forked caches stayed consistent
+		echo, err := model.GenerateContext(context.Background(), beam.Tokens, GenerateConfig{
+			MaxLen: uint32(len(beam.Tokens)) + 1,
+			Echo:   true,
+		})
+		if err != nil {
+			t.Fatalf("Echo failed: %v", err)
+		}
+		sum := float32(0)
+		for _, tok := range echo.PromptLogprobs[len(prompt)-1:] {
+			sum += tok.Logprob
+		}
+		if !tensor.FloatEq(sum, beam.Logprob, 1e-3) {
+			t.Errorf("Beam %d: logprob %v does not match rescored %v", i, beam.Logprob, sum)
+		}
+	}
+}
+
+func TestBeamSearchInvalidConfig(t *testing.T) {
+	model := loadStoryModel(t)
+	if _, err := model.BeamSearch(context.Background(), []uint32{1}, BeamSearchConfig{MaxLen: 10}); err == nil {
+		t.Errorf("Expected an error for zero beams")
+	}
+	if _, err := model.BeamSearch(context.Background(), []uint32{1}, BeamSearchConfig{MaxLen: 10, NumBeams: 2, NumReturn: 3}); err == nil {
+		t.Errorf("Expected an error when returning more beams than the width")
+	}
+}
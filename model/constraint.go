@@ -0,0 +1,57 @@
+package model
+
+import (
+	"errors"
+)
+
+// Constraint restricts generation to outputs of a given shape, such as
+// the documents of a grammar. It is consulted before every token and told
+// about the token that was picked.
+//
+// grammar.Matcher implements Constraint.
+type Constraint interface {
+	// Allowed reports for every token of the vocabulary whether it may
+	// come next.
+	Allowed() []bool
+	// CanEnd reports whether the output may stop here.
+	CanEnd() bool
+	// Accept records the token that was generated.
+	Accept(token uint32) error
+}
+
+// ErrConstraintDeadEnd is returned when a constraint allows neither a
+// token nor the end of the output.
+var ErrConstraintDeadEnd = errors.New("constraint allows no token")
+
+// maskConstraint sets the logits of the tokens c does not allow to -inf.
+// eos is allowed exactly when c can end.
+func maskConstraint(c Constraint, logits *Tensor[float32], eos uint32) error {
+	allowed := c.Allowed()
+	data := logits.Data()
+	none := true
+	for i := range data {
+		ok := i < len(allowed) && allowed[i]
+		if uint32(i) == eos {
+			ok = c.CanEnd()
+		}
+		if !ok {
+			data[i] = negInf
+		}
+		none = none && !ok
+	}
+	if none {
+		return ErrConstraintDeadEnd
+	}
+	return nil
+}
+
+// allMasked reports whether every logit is -inf, as when processors run
+// after maskConstraint have banned all the tokens it left.
+func allMasked(logits []float32) bool {
+	for _, v := range logits {
+		if v != negInf {
+			return false
+		}
+	}
+	return true
+}
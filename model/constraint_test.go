@@ -0,0 +1,172 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"learning-lm-go/grammar"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func loadStoryVocabulary(t testing.TB) *Vocabulary {
+	t.Helper()
+	_, filename, _, _ := runtime.Caller(0)
+	projectDir := filepath.Dir(filepath.Dir(filename))
+	vocab, err := LoadVocabulary(filepath.Join(projectDir, "models", "story", "tokenizer.json"))
+	if err != nil {
+		t.Fatalf("Failed to load vocabulary: %v", err)
+	}
+	return vocab
+}
+
+func TestLoadVocabulary(t *testing.T) {
+	vocab := loadStoryVocabulary(t)
+	if len(vocab.Tokens) != 2048 {
+		t.Fatalf("Expected 2048 tokens, got %d", len(vocab.Tokens))
+	}
+	for id := 0; id < 3; id++ {
+		if vocab.Tokens[id] != nil {
+			t.Errorf("Special token %d should have no text, got %q", id, vocab.Tokens[id])
+		}
+	}
+	if string(vocab.Tokens[3]) != "\n" {
+		t.Errorf("Token 3 should be a newline, got %q", vocab.Tokens[3])
+	}
+	for id, text := range vocab.Tokens {
+		if strings.Contains(string(text), "▁") {
+			t.Errorf("Token %d still contains the space marker: %q", id, text)
+		}
+	}
+}
+
+// constrainedText generates greedily under c and returns the token texts.
+func constrainedText(t *testing.T, model *Llama, vocab *Vocabulary, c Constraint, maxLen uint32) (string, FinishReason) {
+	t.Helper()
+	prompt := []uint32{1, 400, 500}
+	result, err := model.GenerateContext(context.Background(), prompt, GenerateConfig{MaxLen: maxLen, Constraint: c})
+	if err != nil {
+		t.Fatalf("Constrained generation failed: %v", err)
+	}
+	var sb strings.Builder
+	for _, id := range result.Tokens[len(prompt):] {
+		sb.Write(vocab.Tokens[id])
+	}
+	return sb.String(), result.FinishReason
+}
+
+func TestGenerateGrammar(t *testing.T) {
+	model := loadStoryModel(t)
+	vocab := loadStoryVocabulary(t)
+
+	g := grammar.MustParse(`root ::= " " ( "yes" | "no" ) "."`)
+	m, err := grammar.NewMatcher(g, vocab.Tokens)
+	if err != nil {
+		t.Fatalf("NewMatcher failed: %v", err)
+	}
+	text, reason := constrainedText(t, model, vocab, m, 50)
+	if text != " yes." && text != " no." {
+		t.Errorf("Output %q does not match the grammar", text)
+	}
+	if reason != FinishEOS {
+		t.Errorf("Expected the output to end with EOS, got %q", reason)
+	}
+}
+
+func TestGenerateJSONSchema(t *testing.T) {
+	model := loadStoryModel(t)
+	vocab := loadStoryVocabulary(t)
+
+	// the story vocabulary has no braces or brackets, so only scalar
+	// documents can be produced
+	g, err := grammar.FromJSONSchema([]byte(`{"anyOf": [{"enum": ["Tom", "Lily"]}, {"type": "boolean"}]}`))
+	if err != nil {
+		t.Fatalf("FromJSONSchema failed: %v", err)
+	}
+	m, err := grammar.NewMatcher(g, vocab.Tokens)
+	if err != nil {
+		t.Fatalf("NewMatcher failed: %v", err)
+	}
+	text, reason := constrainedText(t, model, vocab, m, 80)
+	if reason != FinishEOS {
+		t.Fatalf("Expected a complete document, got %q (%s)", text, reason)
+	}
+	var doc any
+	if err := json.Unmarshal([]byte(text), &doc); err != nil {
+		t.Fatalf("Output %q is not valid JSON: %v", text, err)
+	}
+	if doc != "Tom" && doc != "Lily" {
+		if _, ok := doc.(bool); !ok {
+			t.Errorf("Output %q does not satisfy the schema", text)
+		}
+	}
+
+	g, err = grammar.FromJSONSchema([]byte(`{"type": "object"}`))
+	if err != nil {
+		t.Fatalf("FromJSONSchema failed: %v", err)
+	}
+	m, err = grammar.NewMatcher(g, vocab.Tokens)
+	if err != nil {
+		t.Fatalf("NewMatcher failed: %v", err)
+	}
+	_, err = model.GenerateContext(context.Background(), []uint32{1}, GenerateConfig{MaxLen: 10, Constraint: m})
+	if !errors.Is(err, ErrConstraintDeadEnd) {
+		t.Errorf("Expected ErrConstraintDeadEnd without a \"{\" token, got %v", err)
+	}
+}
+
+// onlyToken is a Constraint allowing a single token forever.
+type onlyToken struct {
+	token uint32
+	vocab int
+}
+
+func (c onlyToken) Allowed() []bool {
+	allowed := make([]bool, c.vocab)
+	allowed[c.token] = true
+	return allowed
+}
+
+func (c onlyToken) CanEnd() bool { return false }
+
+func (c onlyToken) Accept(token uint32) error { return nil }
+
+func TestConstraintWithProcessors(t *testing.T) {
+	model := loadStoryModel(t)
+	c := onlyToken{token: 400, vocab: model.Config.Vocab}
+
+	// the second 400 repeats the bigram "400 400", which the processor bans
+	for _, sampling := range []SamplingParams{
+		{NoRepeatNGramSize: 2},
+		{NoRepeatNGramSize: 2, Temperature: 1, Seed: 1},
+	} {
+		result, err := model.GenerateContext(context.Background(), []uint32{1, 400}, GenerateConfig{MaxLen: 10, Constraint: c, Sampling: sampling})
+		if !errors.Is(err, ErrConstraintDeadEnd) {
+			t.Errorf("T=%v: expected ErrConstraintDeadEnd, got %v", sampling.Temperature, err)
+		}
+		if len(result.Tokens) != 3 {
+			t.Errorf("T=%v: expected the one allowed token before the dead end, got %v", sampling.Temperature, result.Tokens)
+		}
+	}
+}
+
+func TestGenerateRegex(t *testing.T) {
+	model := loadStoryModel(t)
+	vocab := loadStoryVocabulary(t)
+
+	expr := `( [A-Z][a-z]+){2} (is|was) [a-z]{1,8}\.`
+	re, err := grammar.CompileRegex(expr, vocab.Tokens)
+	if err != nil {
+		t.Fatalf("CompileRegex failed: %v", err)
+	}
+	text, reason := constrainedText(t, model, vocab, re.Matcher(), 60)
+	if reason != FinishEOS {
+		t.Fatalf("Expected a complete match, got %q (%s)", text, reason)
+	}
+	if !regexp.MustCompile(`^(?:` + expr + `)$`).MatchString(text) {
+		t.Errorf("Output %q does not match %s", text, expr)
+	}
+}
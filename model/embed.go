@@ -0,0 +1,130 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"learning-lm-go/tensor"
+	"math"
+)
+
+// Pooling selects how the hidden states of a sequence are reduced to one
+// embedding vector.
+type Pooling string
+
+const (
+	PoolMean Pooling = "mean" // average over the tokens
+	PoolLast Pooling = "last" // hidden state of the last token
+	PoolMax  Pooling = "max"  // element-wise maximum over the tokens
+)
+
+// EmbedConfig describes an embedding request.
+type EmbedConfig struct {
+	// Layer selects the hidden states: 0 takes the output of the final
+	// RMSNorm, the states the LM head reads; 1 to NLayers take the
+	// residual stream after that many decoder layers. Middle layers often
+	// carry more general semantics than the last one.
+	Layer   int
+	Pooling Pooling // "" means PoolMean
+	// Normalize scales the embedding to unit L2 norm, so that the dot
+	// product of two embeddings is their cosine similarity.
+	Normalize bool
+}
+
+// Embed returns a sentence embedding of tokens built from the model's
+// hidden states. Only the layers up to Layer are run.
+func (l *Llama) Embed(ctx context.Context, tokens []uint32, cfg EmbedConfig) ([]float32, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("cannot embed an empty sequence")
+	}
+	if cfg.Layer < 0 || cfg.Layer > l.Config.NLayers {
+		return nil, fmt.Errorf("layer %d out of range [0, %d]", cfg.Layer, l.Config.NLayers)
+	}
+	nLayers := cfg.Layer
+	if nLayers == 0 {
+		nLayers = l.Config.NLayers
+	}
+
+	cache, err := l.NewCache()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache: %v", err)
+	}
+	hidden, err := l.hidden(ctx, tensor.NewTensor(tokens, []uint32{uint32(len(tokens))}), cache, nLayers)
+	if err != nil {
+		return nil, ctxError(ctx, err)
+	}
+	if cfg.Layer == 0 {
+		hidden = l.backend().RMSNorm(hidden, l.Params.RMSOutW, l.Config.RMSNormEps)
+	}
+
+	embedding, err := pool(hidden.Data(), len(tokens), l.Config.D, cfg.Pooling)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Normalize {
+		normalize(embedding)
+	}
+	return embedding, nil
+}
+
+// pool reduces the rows of a (seqLen, d) matrix to one vector.
+func pool(data []float32, seqLen, d int, pooling Pooling) ([]float32, error) {
+	out := make([]float32, d)
+	switch pooling {
+	case PoolMean, "":
+		for i := 0; i < seqLen; i++ {
+			for j, v := range data[i*d : (i+1)*d] {
+				out[j] += v
+			}
+		}
+		for j := range out {
+			out[j] /= float32(seqLen)
+		}
+	case PoolLast:
+		copy(out, data[(seqLen-1)*d:])
+	case PoolMax:
+		copy(out, data[:d])
+		for i := 1; i < seqLen; i++ {
+			for j, v := range data[i*d : (i+1)*d] {
+				out[j] = max(out[j], v)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown pooling %q", pooling)
+	}
+	return out, nil
+}
+
+// normalize scales v to unit L2 norm in place. The zero vector is left
+// unchanged.
+func normalize(v []float32) {
+	sum := float64(0)
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return
+	}
+	scale := float32(1 / math.Sqrt(sum))
+	for i := range v {
+		v[i] *= scale
+	}
+}
+
+// CosineSimilarity returns the cosine of the angle between a and b, or 0
+// if either is the zero vector.
+func CosineSimilarity(a, b []float32) float32 {
+	if len(a) != len(b) {
+		panic("vectors must have the same length")
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return float32(dot / math.Sqrt(na*nb))
+}
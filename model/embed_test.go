@@ -0,0 +1,90 @@
+package model
+
+import (
+	"context"
+	"learning-lm-go/tensor"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestPool(t *testing.T) {
+	data := []float32{
+		1, -2, 3,
+		3, 4, -1,
+	}
+	for pooling, expected := range map[Pooling][]float32{
+		PoolMean: {2, 1, 1},
+		"":       {2, 1, 1},
+		PoolLast: {3, 4, -1},
+		PoolMax:  {3, 4, 3},
+	} {
+		actual, err := pool(data, 2, 3, pooling)
+		if err != nil {
+			t.Fatalf("pool(%q) failed: %v", pooling, err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("pool(%q) = %v, expected %v", pooling, actual, expected)
+		}
+	}
+	if _, err := pool(data, 2, 3, "median"); err == nil {
+		t.Errorf("Unknown pooling should be rejected")
+	}
+
+	v := []float32{3, 4}
+	normalize(v)
+	if !reflect.DeepEqual(v, []float32{0.6, 0.8}) {
+		t.Errorf("normalize = %v", v)
+	}
+	if c := CosineSimilarity([]float32{1, 0}, []float32{1, 1}); math.Abs(float64(c)-math.Sqrt2/2) > 1e-6 {
+		t.Errorf("CosineSimilarity = %v", c)
+	}
+}
+
+func TestEmbed(t *testing.T) {
+	model := loadStoryModel(t)
+	tokens := []uint32{1, 400, 500, 23}
+
+	// the last-token embedding of the final layer feeds the LM head
+	last, err := model.Embed(context.Background(), tokens, EmbedConfig{Pooling: PoolLast})
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+	if len(last) != model.Config.D {
+		t.Fatalf("Expected %d dimensions, got %d", model.Config.D, len(last))
+	}
+	cache, _ := model.NewCache()
+	logits, err := model.Forward(tensor.NewTensor(tokens, []uint32{uint32(len(tokens))}), cache)
+	if err != nil {
+		t.Fatalf("Forward failed: %v", err)
+	}
+	projected := model.backend().MatMulTransB(tensor.NewTensor(last, []uint32{1, uint32(len(last))}), model.Params.LMHead)
+	if ok, err := projected.CloseTo(logits, 1e-4); err != nil || !ok {
+		t.Errorf("Final last-token embedding does not reproduce the logits")
+	}
+
+	for layer := 0; layer <= model.Config.NLayers; layer++ {
+		for _, pooling := range []Pooling{PoolMean, PoolLast, PoolMax} {
+			e, err := model.Embed(context.Background(), tokens, EmbedConfig{Layer: layer, Pooling: pooling, Normalize: true})
+			if err != nil {
+				t.Fatalf("Embed(layer %d, %s) failed: %v", layer, pooling, err)
+			}
+			if sim := CosineSimilarity(e, e); math.Abs(float64(sim)-1) > 1e-5 {
+				t.Errorf("Embedding is not normalized: self similarity %v", sim)
+			}
+		}
+	}
+
+	// a sequence is closer to a prefix of itself than to unrelated tokens
+	cfg := EmbedConfig{Layer: 1, Normalize: true}
+	a, _ := model.Embed(context.Background(), []uint32{1, 400, 500, 23, 97, 88}, cfg)
+	b, _ := model.Embed(context.Background(), []uint32{1, 400, 500, 23, 97}, cfg)
+	c, _ := model.Embed(context.Background(), []uint32{1, 1500, 1600, 1700, 1800, 1900}, cfg)
+	if CosineSimilarity(a, b) <= CosineSimilarity(a, c) {
+		t.Errorf("Expected sim(a, b) = %v > sim(a, c) = %v", CosineSimilarity(a, b), CosineSimilarity(a, c))
+	}
+
+	if _, err := model.Embed(context.Background(), tokens, EmbedConfig{Layer: model.Config.NLayers + 1}); err == nil {
+		t.Errorf("An out of range layer should be rejected")
+	}
+}
@@ -0,0 +1,443 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"learning-lm-go/kvcache"
+	"learning-lm-go/tensor"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrStopGeneration can be returned by a StreamFunc to end generation early.
+// GenerateStream then returns the tokens produced so far and a nil error.
+var ErrStopGeneration = errors.New("generation stopped by consumer")
+
+// Decoder turns token ids back into text. *tokenizers.Tokenizer satisfies it.
+type Decoder interface {
+	Decode(tokenIDs []uint32, skipSpecialTokens bool) string
+}
+
+// FinishReason tells why generation ended.
+type FinishReason string
+
+const (
+	FinishEOS      FinishReason = "eos"      // the model produced Config.EosTokenID
+	FinishLength   FinishReason = "length"   // the sequence reached MaxLen
+	FinishStop     FinishReason = "stop"     // a stop token or stop string was produced
+	FinishCanceled FinishReason = "canceled" // the context or the consumer ended generation
+)
+
+// GenerateConfig describes a single generation request.
+type GenerateConfig struct {
+	MaxLen   uint32 // maximum sequence length, prompt included
+	Sampling SamplingParams
+
+	// Processors and Sampler replace the chain derived from Sampling when
+	// set. Use Sampling.Processors() as a starting point to extend it.
+	Processors []LogitsProcessor
+	Sampler    Sampler
+
+	// Constraint restricts the output to the tokens it allows, see
+	// Constraint. EOS is only allowed where the constraint can end.
+	Constraint Constraint
+
+	// StopTokens end generation like EOS does.
+	StopTokens []uint32
+	// StopStrings end generation as soon as one of them appears in the
+	// decoded output, even when it spans several tokens. Requires Decoder.
+	StopStrings []string
+	// IncludeStop keeps the text of the matched stop token or stop string
+	// in the output text. The tokens are always kept.
+	IncludeStop bool
+
+	// Decoder is used to produce text; without it all text fields are empty.
+	Decoder Decoder
+
+	// TopLogprobs is the number of most likely alternatives reported with
+	// every token.
+	TopLogprobs int
+	// Echo also scores the prompt tokens, see GenerateResult.PromptLogprobs.
+	// The scores come from the prefill, which then keeps the logits of
+	// every prompt position.
+	Echo bool
+
+	// Overflow is what happens when the sequence outgrows the context
+	// window, see OverflowPolicy; empty means OverflowError. KeepTokens is
+	// the number of leading tokens, such as BOS or a system prompt, that
+	// truncation and shifting never drop.
+	Overflow   OverflowPolicy
+	KeepTokens int
+}
+
+// GenerateResult is the outcome of a generation request.
+type GenerateResult struct {
+	Tokens       []uint32 // the prompt followed by every generated token
+	Text         string   // decoded text of the generated tokens, special tokens skipped
+	FinishReason FinishReason
+
+	// Generated holds the details of every generated token, in order.
+	Generated []GeneratedToken
+	// PromptLogprobs[i] scores prompt token i+1 given the tokens before it;
+	// the first prompt token has no score. Only set with Echo. Text is left
+	// empty.
+	PromptLogprobs []GeneratedToken
+}
+
+// GeneratedToken is a single token emitted during streaming generation.
+type GeneratedToken struct {
+	ID uint32
+	// Text is the output text released with this token. Text that could be
+	// the beginning of a stop string is held back until it is ruled out, so
+	// it may lag behind the tokens. Concatenating all fragments yields
+	// GenerateResult.Text.
+	Text    string
+	Logprob float32 // log-probability under the unmodified model distribution
+
+	// TopLogprobs lists the most likely tokens at this position, most likely
+	// first, when GenerateConfig.TopLogprobs is set. The sampled token is
+	// not necessarily among them.
+	TopLogprobs []TokenLogprob
+}
+
+// CanceledError is returned when generation is interrupted by its context.
+// The tokens generated before the interruption are returned alongside it.
+type CanceledError struct {
+	Err error // ctx.Err(): context.Canceled or context.DeadlineExceeded
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("generation canceled: %v", e.Err)
+}
+
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// StreamFunc receives every generated token as soon as it is sampled.
+// Returning ErrStopGeneration stops generation cleanly; any other error
+// aborts it and is returned by GenerateStream.
+type StreamFunc func(tok GeneratedToken) error
+
+// GenerateContext generates a continuation of tokens according to cfg and
+// stops when ctx is done. Cancellation is checked between decode steps and
+// between the layers of each forward pass; a *CanceledError is then returned
+// together with the partial result.
+func (l *Llama) GenerateContext(ctx context.Context, tokens []uint32, cfg GenerateConfig) (*GenerateResult, error) {
+	return l.GenerateStream(ctx, tokens, cfg, nil)
+}
+
+// GenerateStream runs the same decode loop as GenerateContext but hands
+// each token to fn as it is produced. fn may be nil.
+func (l *Llama) GenerateStream(ctx context.Context, tokens []uint32, cfg GenerateConfig, fn StreamFunc) (*GenerateResult, error) {
+	cache, err := l.NewCache()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache: %v", err)
+	}
+	seq, err := l.newSequence(tokens, cfg, cache)
+	if err != nil {
+		return nil, err
+	}
+	for !seq.done() {
+		if err := ctx.Err(); err != nil {
+			return seq.result.fail(ctx, err)
+		}
+		if err := seq.fit(); err != nil {
+			return seq.result, err
+		}
+		input := tensor.NewTensor(seq.pending, []uint32{uint32(len(seq.pending))})
+		logits, err := l.forward(ctx, input, seq.cache, seq.allPositions())
+		if err != nil {
+			return seq.result.fail(ctx, err)
+		}
+		if err := seq.advance(logits, fn); err != nil {
+			return seq.result, err
+		}
+	}
+	return seq.result, nil
+}
+
+// sequence is the decoding state of one generation request.
+type sequence struct {
+	cfg        GenerateConfig
+	eos        uint32
+	vocab      uint32
+	maxSeqLen  int
+	cache      *kvcache.KVCache[float32]
+	window     []uint32 // tokens held by cache
+	processors []LogitsProcessor
+	sampler    Sampler
+	text       *textTracker
+	stops      *stopMatcher
+	result     *GenerateResult
+	pending    []uint32 // tokens fed to the next forward pass
+	prefilled  bool
+}
+
+// newSequence prepares the decoding of tokens. cache is normally empty.
+func (l *Llama) newSequence(tokens []uint32, cfg GenerateConfig, cache *kvcache.KVCache[float32]) (*sequence, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("generation needs a non-empty prompt")
+	}
+	if len(cfg.StopStrings) > 0 && cfg.Decoder == nil {
+		return nil, errors.New("stop strings require a decoder")
+	}
+	switch cfg.Overflow {
+	case "", OverflowError, OverflowTruncateLeft, OverflowShift:
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q", cfg.Overflow)
+	}
+	if cfg.KeepTokens < 0 {
+		return nil, fmt.Errorf("negative KeepTokens %d", cfg.KeepTokens)
+	}
+
+	s := &sequence{
+		cfg:        cfg,
+		eos:        l.Config.EosTokenID,
+		vocab:      uint32(l.Config.Vocab),
+		maxSeqLen:  l.Config.MaxSeqLen,
+		cache:      cache,
+		processors: cfg.Processors,
+		sampler:    cfg.Sampler,
+		text:       newTextTracker(cfg.Decoder, tokens),
+		stops:      newStopMatcher(cfg.StopStrings, cfg.IncludeStop),
+		result:     &GenerateResult{Tokens: append([]uint32(nil), tokens...)},
+		pending:    tokens,
+	}
+	if s.processors == nil {
+		s.processors = cfg.Sampling.Processors()
+	}
+	if s.sampler == nil {
+		s.sampler = cfg.Sampling.Sampler()
+	}
+	return s, nil
+}
+
+func (s *sequence) done() bool {
+	return s.result.FinishReason != ""
+}
+
+// allPositions reports whether the next forward pass has to return the
+// logits of every input position, which is the case for the prefill when
+// the prompt is echoed.
+func (s *sequence) allPositions() bool {
+	return s.cfg.Echo && !s.prefilled
+}
+
+// advance consumes the logits of the last forward pass: it samples the
+// next token, checks the stop conditions and hands the token to fn.
+func (s *sequence) advance(logits *Tensor[float32], fn StreamFunc) error {
+	cfg := s.cfg
+	result := s.result
+	s.window = append(s.window, s.pending...)
+	if s.allPositions() {
+		// row i scores prompt token i+1, the last row the first new token
+		rows := logits.Size() / s.vocab
+		for i := uint32(0); i+1 < rows; i++ {
+			lp := newLogprobs(logits.Slice(i*s.vocab, []uint32{1, s.vocab}).Data())
+			next := s.pending[i+1]
+			result.PromptLogprobs = append(result.PromptLogprobs, GeneratedToken{
+				ID:          next,
+				Logprob:     lp.Of(next),
+				TopLogprobs: lp.Top(cfg.TopLogprobs),
+			})
+		}
+		logits = logits.Slice((rows-1)*s.vocab, []uint32{1, s.vocab})
+	}
+	s.prefilled = true
+
+	// the processors rewrite logits in place, keep the raw scores for the logprobs
+	lp := newLogprobs(append([]float32(nil), logits.Data()...))
+
+	if cfg.Constraint != nil {
+		if err := maskConstraint(cfg.Constraint, logits, s.eos); err != nil {
+			return err
+		}
+	}
+	ApplyProcessors(s.processors, logits, result.Tokens)
+	if cfg.Constraint != nil && allMasked(logits.Data()) {
+		return fmt.Errorf("%w: the logits processors removed every token it allows", ErrConstraintDeadEnd)
+	}
+	next := s.sampler.Sample(logits)
+	result.Tokens = append(result.Tokens, next)
+	if cfg.Constraint != nil && next != s.eos {
+		if err := cfg.Constraint.Accept(next); err != nil {
+			return err
+		}
+	}
+
+	fragment := s.text.Append(next)
+	switch {
+	case next == s.eos:
+		result.FinishReason = FinishEOS
+	case containsToken(cfg.StopTokens, next):
+		result.FinishReason = FinishStop
+		if !cfg.IncludeStop {
+			fragment = ""
+		}
+	}
+	released, matched := s.stops.Push(fragment)
+	if matched {
+		result.FinishReason = FinishStop
+	} else if result.FinishReason == "" && uint32(len(result.Tokens)) >= cfg.MaxLen {
+		result.FinishReason = FinishLength
+	}
+	if result.FinishReason != "" {
+		released += s.stops.Flush()
+	}
+	result.Text += released
+
+	generated := GeneratedToken{
+		ID:          next,
+		Text:        released,
+		Logprob:     lp.Of(next),
+		TopLogprobs: lp.Top(cfg.TopLogprobs),
+	}
+	result.Generated = append(result.Generated, generated)
+	s.pending = []uint32{next}
+
+	if fn != nil {
+		err := fn(generated)
+		if errors.Is(err, ErrStopGeneration) {
+			if result.FinishReason == "" {
+				result.FinishReason = FinishCanceled
+			}
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// fail ends generation with err, turning errors caused by ctx into a
+// *CanceledError.
+func (r *GenerateResult) fail(ctx context.Context, err error) (*GenerateResult, error) {
+	if ctx.Err() != nil {
+		r.FinishReason = FinishCanceled
+		return r, &CanceledError{Err: ctx.Err()}
+	}
+	return r, err
+}
+
+func containsToken(tokens []uint32, token uint32) bool {
+	for _, t := range tokens {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+// textTracker turns a growing token sequence into text fragments.
+//
+// Tokens are decoded together with everything before them so that merges
+// made by the tokenizer's decoder (leading-space stripping, byte fallback)
+// come out the same as decoding the whole sequence at once. Text that ends
+// in an incomplete UTF-8 sequence is held back until the following tokens
+// complete it.
+type textTracker struct {
+	dec     Decoder
+	tokens  []uint32
+	emitted string
+}
+
+func newTextTracker(dec Decoder, prompt []uint32) *textTracker {
+	t := &textTracker{dec: dec}
+	if dec == nil {
+		return t
+	}
+	t.tokens = append(t.tokens, prompt...)
+	t.emitted = dec.Decode(t.tokens, true)
+	return t
+}
+
+// Append adds a token and returns the newly available text.
+func (t *textTracker) Append(token uint32) string {
+	if t.dec == nil {
+		return ""
+	}
+	t.tokens = append(t.tokens, token)
+	full := t.dec.Decode(t.tokens, true)
+	if strings.HasSuffix(full, string(utf8.RuneError)) {
+		return ""
+	}
+	if !strings.HasPrefix(full, t.emitted) {
+		// the decoder rewrote earlier text; resync without re-emitting it
+		t.emitted = full
+		return ""
+	}
+	fragment := full[len(t.emitted):]
+	t.emitted = full
+	return fragment
+}
+
+// stopMatcher finds stop strings in streamed text.
+//
+// Text is released as soon as it can no longer be part of a stop string.
+// Any suffix that is still a prefix of some stop string is held back, so a
+// match always starts inside the held text.
+type stopMatcher struct {
+	stops       []string
+	includeStop bool
+	held        string
+}
+
+func newStopMatcher(stops []string, includeStop bool) *stopMatcher {
+	nonEmpty := make([]string, 0, len(stops))
+	for _, s := range stops {
+		if s != "" {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+	return &stopMatcher{stops: nonEmpty, includeStop: includeStop}
+}
+
+// Push adds a fragment of text. It returns the text that can be released
+// and whether a stop string was matched, in which case the released text
+// ends right before (or, with includeStop, right after) the match and
+// nothing is held back anymore.
+func (m *stopMatcher) Push(fragment string) (string, bool) {
+	m.held += fragment
+	if len(m.stops) == 0 {
+		out := m.held
+		m.held = ""
+		return out, false
+	}
+
+	matchAt, matchLen := -1, 0
+	for _, s := range m.stops {
+		if idx := strings.Index(m.held, s); idx >= 0 && (matchAt < 0 || idx < matchAt) {
+			matchAt, matchLen = idx, len(s)
+		}
+	}
+	if matchAt >= 0 {
+		end := matchAt
+		if m.includeStop {
+			end += matchLen
+		}
+		out := m.held[:end]
+		m.held = ""
+		return out, true
+	}
+
+	keep := 0
+	for _, s := range m.stops {
+		for n := min(len(s)-1, len(m.held)); n > keep; n-- {
+			if strings.HasSuffix(m.held, s[:n]) {
+				keep = n
+				break
+			}
+		}
+	}
+	out := m.held[:len(m.held)-keep]
+	m.held = m.held[len(m.held)-keep:]
+	return out, false
+}
+
+// Flush releases whatever text is still held back.
+func (m *stopMatcher) Flush() string {
+	out := m.held
+	m.held = ""
+	return out
+}
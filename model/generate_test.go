@@ -0,0 +1,312 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"learning-lm-go/tensor"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeDecoder decodes token id i to the i-th word, separated by spaces.
+type fakeDecoder []string
+
+func (d fakeDecoder) Decode(tokenIDs []uint32, skipSpecialTokens bool) string {
+	words := make([]string, 0, len(tokenIDs))
+	for _, id := range tokenIDs {
+		words = append(words, d[int(id)%len(d)])
+	}
+	return strings.Join(words, " ")
+}
+
+// idDecoder decodes every token to its id in brackets.
+type idDecoder struct{}
+
+func (idDecoder) Decode(tokenIDs []uint32, skipSpecialTokens bool) string {
+	var sb strings.Builder
+	for _, id := range tokenIDs {
+		fmt.Fprintf(&sb, "<%d>", id)
+	}
+	return sb.String()
+}
+
+func TestGenerateStream(t *testing.T) {
+	model := loadStoryModel(t)
+	prompt := []uint32{1, 400, 500}
+	params := SamplingParams{Temperature: 0.8, TopK: 20, Seed: 3}
+
+	expected, err := model.GenerateWithParams(prompt, 20, params)
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	var streamed []uint32
+	var text strings.Builder
+	cfg := GenerateConfig{MaxLen: 20, Sampling: params, Decoder: idDecoder{}}
+	result, err := model.GenerateStream(context.Background(), prompt, cfg, func(tok GeneratedToken) error {
+		if tok.Logprob > 0 {
+			t.Errorf("Logprob must not be positive, got %v", tok.Logprob)
+		}
+		streamed = append(streamed, tok.ID)
+		text.WriteString(tok.Text)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("GenerateStream failed: %v", err)
+	}
+	if !reflect.DeepEqual(result.Tokens, expected) {
+		t.Errorf("Stream output differs from Generate: %v vs %v", result.Tokens, expected)
+	}
+	if !reflect.DeepEqual(streamed, expected[len(prompt):]) {
+		t.Errorf("Streamed tokens %v do not match generated tokens %v", streamed, expected[len(prompt):])
+	}
+	if text.String() != result.Text || result.Text != (idDecoder{}).Decode(streamed, true) {
+		t.Errorf("Streamed text %q does not match result text %q", text.String(), result.Text)
+	}
+	if result.FinishReason != FinishLength && result.FinishReason != FinishEOS {
+		t.Errorf("Unexpected finish reason %q", result.FinishReason)
+	}
+}
+
+func TestGenerateStreamStop(t *testing.T) {
+	model := loadStoryModel(t)
+	prompt := []uint32{1, 400, 500}
+	cfg := GenerateConfig{MaxLen: 100}
+
+	count := 0
+	result, err := model.GenerateStream(context.Background(), prompt, cfg, func(tok GeneratedToken) error {
+		count++
+		if count == 5 {
+			return ErrStopGeneration
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ErrStopGeneration should not be returned, got %v", err)
+	}
+	if len(result.Tokens) != len(prompt)+5 || result.FinishReason != FinishCanceled {
+		t.Errorf("Expected %d tokens and reason %q, got %d and %q",
+			len(prompt)+5, FinishCanceled, len(result.Tokens), result.FinishReason)
+	}
+
+	boom := errors.New("boom")
+	_, err = model.GenerateStream(context.Background(), prompt, cfg, func(tok GeneratedToken) error {
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Errorf("Expected consumer error to be returned, got %v", err)
+	}
+}
+
+func TestTextTracker(t *testing.T) {
+	dec := fakeDecoder{"a", "b", "c"}
+	tracker := newTextTracker(dec, []uint32{0})
+	var sb strings.Builder
+	for _, id := range []uint32{1, 2, 0} {
+		sb.WriteString(tracker.Append(id))
+	}
+	if sb.String() != " b c a" {
+		t.Errorf("Unexpected streamed text %q", sb.String())
+	}
+
+	if newTextTracker(nil, []uint32{0}).Append(1) != "" {
+		t.Errorf("Expected empty text without a decoder")
+	}
+}
+
+func TestGenerateContextCancel(t *testing.T) {
+	model := loadStoryModel(t)
+	prompt := []uint32{1, 400, 500}
+	cfg := GenerateConfig{MaxLen: 100}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	count := 0
+	result, err := model.GenerateStream(ctx, prompt, cfg, func(tok GeneratedToken) error {
+		count++
+		if count == 3 {
+			cancel()
+		}
+		return nil
+	})
+	var canceled *CanceledError
+	if !errors.As(err, &canceled) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a CanceledError wrapping context.Canceled, got %v", err)
+	}
+	if len(result.Tokens) != len(prompt)+3 || result.FinishReason != FinishCanceled {
+		t.Errorf("Expected partial output of %d tokens, got %v (%q)", len(prompt)+3, result.Tokens, result.FinishReason)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	result, err = model.GenerateContext(ctx, prompt, cfg)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if !reflect.DeepEqual(result.Tokens, prompt) {
+		t.Errorf("Expected only the prompt back, got %v", result.Tokens)
+	}
+}
+
+func TestGenerateStopConditions(t *testing.T) {
+	model := loadStoryModel(t)
+	prompt := []uint32{1, 400, 500}
+	base := GenerateConfig{MaxLen: 20, Decoder: idDecoder{}}
+
+	full, err := model.GenerateContext(context.Background(), prompt, base)
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	generated := full.Tokens[len(prompt):]
+	if len(generated) < 6 {
+		t.Fatalf("Expected at least 6 generated tokens, got %v", generated)
+	}
+
+	// stop token
+	cfg := base
+	cfg.StopTokens = []uint32{generated[3]}
+	result, _ := model.GenerateContext(context.Background(), prompt, cfg)
+	if result.FinishReason != FinishStop || len(result.Tokens) != len(prompt)+4 {
+		t.Errorf("Stop token: got %v (%q)", result.Tokens, result.FinishReason)
+	}
+	if result.Text != (idDecoder{}).Decode(generated[:3], true) {
+		t.Errorf("Stop token text should be excluded, got %q", result.Text)
+	}
+
+	// stop string straddling the boundary between the 4th and 5th token
+	tail := fmt.Sprintf("%d>", generated[3])
+	stop := tail[len(tail)-2:] + fmt.Sprintf("<%d", generated[4])
+	cfg = base
+	cfg.StopStrings = []string{stop}
+	result, _ = model.GenerateContext(context.Background(), prompt, cfg)
+	expectedText := (idDecoder{}).Decode(generated[:4], true)
+	expectedText = expectedText[:len(expectedText)-2]
+	if result.FinishReason != FinishStop || len(result.Tokens) != len(prompt)+5 {
+		t.Errorf("Stop string: got %v (%q)", result.Tokens, result.FinishReason)
+	}
+	if result.Text != expectedText {
+		t.Errorf("Stop string: expected text %q, got %q", expectedText, result.Text)
+	}
+
+	cfg.IncludeStop = true
+	result, _ = model.GenerateContext(context.Background(), prompt, cfg)
+	if result.Text != expectedText+stop {
+		t.Errorf("Stop string: expected text %q, got %q", expectedText+stop, result.Text)
+	}
+
+	cfg.Decoder = nil
+	if _, err := model.GenerateContext(context.Background(), prompt, cfg); err == nil {
+		t.Errorf("Stop strings without a decoder should be rejected")
+	}
+}
+
+func TestStopMatcher(t *testing.T) {
+	m := newStopMatcher([]string{"END", "xyz"}, false)
+	var out strings.Builder
+	for _, fragment := range []string{"ab", "cE", "N", "x", "EN"} {
+		released, matched := m.Push(fragment)
+		out.WriteString(released)
+		if matched {
+			t.Fatalf("Unexpected match after %q", fragment)
+		}
+	}
+	if out.String() != "abcENx" {
+		t.Errorf("Expected held-back text to stop at a possible match, got %q", out.String())
+	}
+	released, matched := m.Push("D!")
+	if !matched || released != "" {
+		t.Errorf("Expected a match with no extra text, got %q, %v", released, matched)
+	}
+
+	m = newStopMatcher([]string{"END"}, true)
+	released, matched = m.Push("the END is near")
+	if !matched || released != "the END" {
+		t.Errorf("Expected %q with the stop text, got %q, %v", "the END", released, matched)
+	}
+}
+
+func TestGenerateNoRepeatNGram(t *testing.T) {
+	model := loadStoryModel(t)
+	prompt := []uint32{1, 400, 500}
+	cfg := GenerateConfig{MaxLen: 120, Sampling: SamplingParams{NoRepeatNGramSize: 3}}
+
+	result, err := model.GenerateContext(context.Background(), prompt, cfg)
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	seen := make(map[[3]uint32]bool)
+	for i := 0; i+3 <= len(result.Tokens); i++ {
+		gram := [3]uint32{result.Tokens[i], result.Tokens[i+1], result.Tokens[i+2]}
+		if seen[gram] {
+			t.Fatalf("Trigram %v repeated in %v", gram, result.Tokens)
+		}
+		seen[gram] = true
+	}
+}
+
+func TestGenerateCustomProcessors(t *testing.T) {
+	model := loadStoryModel(t)
+	prompt := []uint32{1, 400, 500}
+
+	greedy, _ := model.GenerateContext(context.Background(), prompt, GenerateConfig{MaxLen: 20})
+	banned := greedy.Tokens[len(prompt)]
+
+	cfg := GenerateConfig{
+		MaxLen:     20,
+		Processors: append(SamplingParams{}.Processors(), LogitBiasProcessor{Bias: map[uint32]float32{banned: negInf}}),
+		Sampler:    GreedySampler{},
+	}
+	result, err := model.GenerateContext(context.Background(), prompt, cfg)
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	for _, tok := range result.Tokens[len(prompt):] {
+		if tok == banned {
+			t.Fatalf("Banned token %d was generated: %v", banned, result.Tokens)
+		}
+	}
+}
+
+func TestGenerateLogprobs(t *testing.T) {
+	model := loadStoryModel(t)
+	prompt := []uint32{1, 400, 500}
+
+	result, err := model.GenerateContext(context.Background(), prompt, GenerateConfig{MaxLen: 12, TopLogprobs: 3})
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	if len(result.Generated) != len(result.Tokens)-len(prompt) {
+		t.Fatalf("Expected one entry per generated token, got %d", len(result.Generated))
+	}
+	for i, tok := range result.Generated {
+		if len(tok.TopLogprobs) != 3 {
+			t.Fatalf("Expected 3 alternatives, got %v", tok.TopLogprobs)
+		}
+		// greedy decoding picks the most likely alternative
+		if tok.ID != tok.TopLogprobs[0].ID || tok.Logprob != tok.TopLogprobs[0].Logprob {
+			t.Errorf("Token %d: %v is not the top alternative %v", i, tok, tok.TopLogprobs[0])
+		}
+		if tok.TopLogprobs[1].Logprob > tok.TopLogprobs[0].Logprob {
+			t.Errorf("Token %d: alternatives are not sorted: %v", i, tok.TopLogprobs)
+		}
+	}
+
+	// echoing the generated sequence scores it the same way
+	echo, err := model.GenerateContext(context.Background(), result.Tokens, GenerateConfig{
+		MaxLen: uint32(len(result.Tokens)) + 1,
+		Echo:   true,
+	})
+	if err != nil {
+		t.Fatalf("Echo failed: %v", err)
+	}
+	if len(echo.PromptLogprobs) != len(result.Tokens)-1 {
+		t.Fatalf("Expected %d prompt logprobs, got %d", len(result.Tokens)-1, len(echo.PromptLogprobs))
+	}
+	for i, tok := range result.Generated {
+		scored := echo.PromptLogprobs[len(prompt)-1+i]
+		if scored.ID != tok.ID || !tensor.FloatEq(scored.Logprob, tok.Logprob, 1e-3) {
+			t.Errorf("Token %d: echo scored %v, generation reported %v", i, scored, tok)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package model
+
+// TokenLogprob is a token together with its log-probability.
+type TokenLogprob struct {
+	ID      uint32
+	Logprob float32
+}
+
+// logprobs evaluates log-softmax over a row of raw logits.
+type logprobs struct {
+	logits []float32
+	lse    float64
+}
+
+func newLogprobs(logits []float32) logprobs {
+	return logprobs{logits: logits, lse: logSumExp(logits)}
+}
+
+// Of returns the log-probability of token id.
+func (lp logprobs) Of(id uint32) float32 {
+	return float32(float64(lp.logits[id]) - lp.lse)
+}
+
+// Top returns the n most likely tokens, most likely first.
+func (lp logprobs) Top(n int) []TokenLogprob {
+	if n <= 0 {
+		return nil
+	}
+	n = min(n, len(lp.logits))
+	order := sortedIndices(lp.logits)[:n]
+	top := make([]TokenLogprob, n)
+	for i, id := range order {
+		top[i] = TokenLogprob{ID: id, Logprob: lp.Of(id)}
+	}
+	return top
+}
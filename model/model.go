@@ -1,12 +1,15 @@
 package model
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"learning-lm-go/kvcache"
 	"learning-lm-go/tensor"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type Tensor[T tensor.TensorDataType] = tensor.Tensor[T]
@@ -26,12 +29,56 @@ type LlamaConfig struct {
 	EosTokenID uint32  `json:"eos_token_id"`
 }
 
+// Errors returned by the forward pass, wrapped with the details of the
+// failure. Match them with errors.Is.
+var (
+	// ErrCapacityExceeded means the input does not fit in the KV cache,
+	// see ContextOverflowError.
+	ErrCapacityExceeded = errors.New("KV cache capacity exceeded")
+	// ErrShapeMismatch means the input, the cache or an intermediate
+	// tensor does not have the shape the model expects.
+	ErrShapeMismatch = errors.New("shape mismatch")
+	// ErrInvalidToken means an input token ID is not below Config.Vocab.
+	ErrInvalidToken = errors.New("invalid token ID")
+)
+
 type Llama struct {
 	Config *LlamaConfig
 	Params *LlamaParams[float32]
+	// Backend computes the operators; nil means tensor.ReferenceBackend.
+	Backend tensor.Backend
+}
+
+// Option configures the model built by FromSafeTensors.
+type Option func(*options)
+
+type options struct {
+	backend  tensor.Backend
+	quantize tensor.QuantType
+}
+
+// WithBackend runs the model on b instead of the reference backend.
+func WithBackend(b tensor.Backend) Option {
+	return func(o *options) {
+		o.backend = b
+	}
+}
+
+// WithQuantization quantizes the weight matrices to typ while loading.
+// Matrices whose rows are not a multiple of tensor.QuantBlockSize long keep
+// the format of the checkpoint.
+func WithQuantization(typ tensor.QuantType) Option {
+	return func(o *options) {
+		o.quantize = typ
+	}
 }
 
-func FromSafeTensors(modelDir string) (*Llama, error) {
+func FromSafeTensors(modelDir string, opts ...Option) (*Llama, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	configPath := filepath.Join(modelDir, "config.json")
 	configData, err := os.ReadFile(configPath)
 	if err != nil {
@@ -52,115 +99,208 @@ func FromSafeTensors(modelDir string) (*Llama, error) {
 	config.DQKV = config.D / config.NQH
 
 	modelPath := filepath.Join(modelDir, "model.safetensors")
-	params, err := ParamsFromSafeTensors(modelPath)
+	params, err := loadParams(modelPath, o.quantize)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse model file: %v", err)
 	}
 
 	return &Llama{
-		Config: &config,
-		Params: params,
+		Config:  &config,
+		Params:  params,
+		Backend: o.backend,
 	}, nil
 }
 
-func (l *Llama) Generate(tokens []uint32, maxLen uint32, top_p float32, top_k uint32, temperature float32) ([]uint32, error) {
-	cache, err := kvcache.NewKVCache[float32](
+func (l *Llama) backend() tensor.Backend {
+	if l.Backend == nil {
+		return tensor.ReferenceBackend{}
+	}
+	return l.Backend
+}
+
+// NewCache returns an empty KV cache sized for this model.
+func (l *Llama) NewCache() (*kvcache.KVCache[float32], error) {
+	return kvcache.NewKVCache[float32](
 		uint32(l.Config.NLayers),
 		uint32(l.Config.MaxSeqLen),
 		uint32(l.Config.DQKV*l.Config.NKVH),
 		0,
 	)
+}
+
+// Generate samples a continuation of tokens until EOS or until the sequence
+// (prompt included) reaches maxLen tokens. The random source is seeded from
+// the current time; use GenerateWithParams for reproducible output.
+func (l *Llama) Generate(tokens []uint32, maxLen uint32, top_p float32, top_k uint32, temperature float32) ([]uint32, error) {
+	return l.GenerateWithParams(tokens, maxLen, SamplingParams{
+		Temperature: temperature,
+		TopK:        top_k,
+		TopP:        top_p,
+		Seed:        time.Now().UnixNano(),
+	})
+}
+
+// GenerateWithParams is like Generate but takes the full sampling
+// configuration, including the seed.
+func (l *Llama) GenerateWithParams(tokens []uint32, maxLen uint32, params SamplingParams) ([]uint32, error) {
+	result, err := l.GenerateContext(context.Background(), tokens, GenerateConfig{
+		MaxLen:   maxLen,
+		Sampling: params,
+	})
 	if err != nil {
-		return []uint32{}, fmt.Errorf("failed to create cache: %v", err)
+		return []uint32{}, err
 	}
+	return result.Tokens, nil
+}
 
-	finalSeq := make([]uint32, len(tokens))
-	copy(finalSeq, tokens)
+// Forward runs input through the model, appending its keys and values to
+// cache, and returns the logits of the last position. Invalid input is
+// reported with one of the errors above and leaves cache untouched.
+func (l *Llama) Forward(input *Tensor[uint32], cache *kvcache.KVCache[float32]) (*Tensor[float32], error) {
+	return l.ForwardContext(context.Background(), input, cache)
+}
 
-	for {
-		logits := l.Forward(tensor.NewTensor(tokens, []uint32{uint32(len(tokens))}), cache)
+// ForwardContext is like Forward but checks ctx before every decoder layer,
+// so a long prefill can be interrupted. On cancellation it returns ctx.Err();
+// the tokens of input are then already counted in cache and the cache should
+// be discarded.
+func (l *Llama) ForwardContext(ctx context.Context, input *Tensor[uint32], cache *kvcache.KVCache[float32]) (*Tensor[float32], error) {
+	return l.forward(ctx, input, cache, false)
+}
 
-		maxIdx := uint32(0)
-		maxProb := logits.Data()[0]
-		for i := 1; i < int(logits.Size()); i++ {
-			if logits.Data()[i] > maxProb {
-				maxProb = logits.Data()[i]
-				maxIdx = uint32(i)
-			}
-		}
+// ForwardAll is like Forward but returns the logits of every position of
+// input as a (seqLen, vocab) tensor: row i scores the token following
+// input[i]. This is what scoring a whole sequence needs.
+func (l *Llama) ForwardAll(input *Tensor[uint32], cache *kvcache.KVCache[float32]) (*Tensor[float32], error) {
+	return l.ForwardAllContext(context.Background(), input, cache)
+}
 
-		tokens = []uint32{maxIdx}
-		finalSeq = append(finalSeq, maxIdx)
-		if maxIdx == l.Config.EosTokenID || uint32(len(finalSeq)) >= maxLen {
-			break
-		}
+// ForwardAllContext is the context-aware variant of ForwardAll, see
+// ForwardContext.
+func (l *Llama) ForwardAllContext(ctx context.Context, input *Tensor[uint32], cache *kvcache.KVCache[float32]) (*Tensor[float32], error) {
+	return l.forward(ctx, input, cache, true)
+}
+
+// forward runs the decoder over input. With allPositions the logits of
+// every input position are returned as a (seqLen, vocab) tensor, otherwise
+// only those of the last position.
+func (l *Llama) forward(ctx context.Context, input *Tensor[uint32], cache *kvcache.KVCache[float32], allPositions bool) (*Tensor[float32], error) {
+	logits, err := l.forwardBatch(ctx, [][]uint32{input.Data()}, []*kvcache.KVCache[float32]{cache}, []bool{allPositions})
+	if err != nil {
+		return nil, err
 	}
-	return finalSeq, nil
+	return logits[0], nil
 }
 
-func (l *Llama) Forward(input *Tensor[uint32], cache *kvcache.KVCache[float32]) *Tensor[float32] {
-	seqLen := input.Size()
-	pastSeqLen := cache.Len()
-	cache.Increment(seqLen)
+// forwardBatch runs one forward pass over several sequences, each with its
+// own cache. logits[i] holds the last row of inputs[i], or all of its rows
+// if allPositions[i].
+func (l *Llama) forwardBatch(ctx context.Context, inputs [][]uint32, caches []*kvcache.KVCache[float32], allPositions []bool) ([]*Tensor[float32], error) {
+	residual, err := l.hiddenBatch(ctx, inputs, caches, l.Config.NLayers)
+	if err != nil {
+		return nil, err
+	}
 
-	totalSeqLen := seqLen + pastSeqLen
-	// nGroups := l.Config.NQH / l.Config.NKVH
+	// keep only the rows whose logits are wanted
+	d := uint32(l.Config.D)
+	var rows []float32
+	counts := make([]uint32, len(inputs))
+	offset := uint32(0)
+	for i, input := range inputs {
+		seqLen := uint32(len(input))
+		first := offset + seqLen - 1
+		if allPositions[i] {
+			first = offset
+		}
+		rows = append(rows, residual.Data()[first*d:(offset+seqLen)*d]...)
+		counts[i] = offset + seqLen - first
+		offset += seqLen
+	}
+	nRows := uint32(len(rows)) / d
 
-	residual := tensor.Gather(l.Params.EmbeddingTable, input)
-
-	for i := 0; i < l.Config.NLayers; i++ {
-		hidden := tensor.RMSNorm(residual, l.Params.RMSAttW[i], l.Config.RMSNormEps)
-		q := tensor.MatMulTransB(hidden, l.Params.WQ[i])
-		k := tensor.MatMulTransB(hidden, l.Params.WK[i])
-		v := tensor.MatMulTransB(hidden, l.Params.WV[i])
-		tensor.Rope(
-			q.Reshape([]uint32{seqLen, uint32(l.Config.NQH), uint32(l.Config.DQKV)}),
-			pastSeqLen,
-			l.Config.RopeTheta,
-		)
-		tensor.Rope(
-			k.Reshape([]uint32{seqLen, uint32(l.Config.NKVH), uint32(l.Config.DQKV)}),
-			pastSeqLen,
-			l.Config.RopeTheta,
-		)
-		v.Reshape([]uint32{seqLen, uint32(l.Config.NKVH), uint32(l.Config.DQKV)})
+	b := l.backend()
+	final_norm := b.RMSNorm(
+		tensor.NewTensor(rows, []uint32{nRows, d}),
+		l.Params.RMSOutW, // 最终层的归一化权重
+		l.Config.RMSNormEps,
+	)
+	all := b.MatMulTransB(final_norm, l.Params.LMHead) // 输出投影层
+	vocab := uint32(l.Config.Vocab)
+	if all.Size() != nRows*vocab {
+		return nil, fmt.Errorf("%w: got %d logits for %d rows of vocabulary size %d", ErrShapeMismatch, all.Size(), nRows, vocab)
+	}
 
-		fullK, err := cache.KCache(uint32(i), 0)
-		if err != nil {
-			panic(err)
-		}
-		fullV, err := cache.VCache(uint32(i), 0)
-		if err != nil {
-			panic(err)
-		}
+	logits := make([]*Tensor[float32], len(inputs))
+	offset = 0
+	for i, n := range counts {
+		logits[i] = all.Slice(offset*vocab, []uint32{n, vocab})
+		offset += n
+	}
+	return logits, nil
+}
 
-		copy(
-			fullK.Data()[int(pastSeqLen)*l.Config.NKVH*l.Config.DQKV:int(totalSeqLen)*l.Config.NKVH*l.Config.DQKV],
-			k.Data(),
-		)
+// hidden runs the first nLayers decoder layers over input and returns the
+// residual stream, a (seqLen, D) tensor.
+func (l *Llama) hidden(ctx context.Context, input *Tensor[uint32], cache *kvcache.KVCache[float32], nLayers int) (*Tensor[float32], error) {
+	return l.hiddenBatch(ctx, [][]uint32{input.Data()}, []*kvcache.KVCache[float32]{cache}, nLayers)
+}
 
-		copy(
-			fullV.Data()[int(pastSeqLen)*l.Config.NKVH*l.Config.DQKV:int(totalSeqLen)*l.Config.NKVH*l.Config.DQKV],
-			v.Data(),
-		)
+// hiddenBatch runs the first nLayers decoder layers over several sequences
+// at once and returns their residual streams packed one after the other.
+//
+// The rows of all sequences are stacked into one matrix, so each
+// projection and the FFN are a single MatMulTransB over the whole batch.
+// Only RoPE and attention, which depend on the position and the cache of
+// each sequence, run per sequence; sequences of different lengths need no
+// padding.
+func (l *Llama) hiddenBatch(ctx context.Context, inputs [][]uint32, caches []*kvcache.KVCache[float32], nLayers int) (*Tensor[float32], error) {
+	// validate everything before the caches are touched
+	if len(caches) != len(inputs) {
+		return nil, fmt.Errorf("%w: %d caches for %d sequences", ErrShapeMismatch, len(caches), len(inputs))
+	}
+	for i, input := range inputs {
+		if err := l.checkInput(input, caches[i], nLayers); err != nil {
+			return nil, fmt.Errorf("sequence %d: %w", i, err)
+		}
+	}
+	var packed []uint32
+	pastSeqLens := make([]uint32, len(inputs))
+	for i, input := range inputs {
+		pastSeqLens[i] = caches[i].Len()
+		if err := caches[i].Increment(uint32(len(input))); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCapacityExceeded, err)
+		}
+		packed = append(packed, input...)
+	}
+	total := uint32(len(packed))
+	// nGroups := l.Config.NQH / l.Config.NKVH
 
-		fullK.Reshape([]uint32{totalSeqLen, uint32(l.Config.NKVH), uint32(l.Config.DQKV)})
-		fullV.Reshape([]uint32{totalSeqLen, uint32(l.Config.NKVH), uint32(l.Config.DQKV)})
+	b := l.backend()
+	residual := b.Gather(l.Params.EmbeddingTable, tensor.NewTensor(packed, []uint32{total}))
 
-		score, err := tensor.GroupAttnScore(q, fullK)
-		if err != nil {
-			panic(err)
+	for i := 0; i < nLayers; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
-		attnV, err := tensor.GroupAttnV(score, fullV)
-		if err != nil {
-			panic(err)
+		hidden := b.RMSNorm(residual, l.Params.RMSAttW[i], l.Config.RMSNormEps)
+		q := b.MatMulTransB(hidden, l.Params.WQ[i])
+		k := b.MatMulTransB(hidden, l.Params.WK[i])
+		v := b.MatMulTransB(hidden, l.Params.WV[i])
+
+		attnV := tensor.EmptyTensor[float32]([]uint32{total, uint32(l.Config.NQH * l.Config.DQKV)})
+		offset := uint32(0)
+		for j, input := range inputs {
+			seqLen := uint32(len(input))
+			if err := l.attention(i, caches[j], pastSeqLens[j], offset, seqLen, q, k, v, attnV); err != nil {
+				return nil, fmt.Errorf("layer %d, sequence %d: %w", i, j, err)
+			}
+			offset += seqLen
 		}
-		attnV.Reshape([]uint32{seqLen, uint32(l.Config.NQH * l.Config.DQKV)})
 
-		out := tensor.MatMulTransB(attnV, l.Params.WO[i])
-		residual = tensor.Add(residual, out)
+		out := b.MatMulTransB(attnV, l.Params.WO[i])
+		residual = b.Add(residual, out)
 
-		residual = FFN(residual,
+		residual = ffn(b, residual,
 			l.Params.WUp[i],
 			l.Params.WDown[i],
 			l.Params.WGate[i],
@@ -168,26 +308,82 @@ func (l *Llama) Forward(input *Tensor[uint32], cache *kvcache.KVCache[float32])
 			l.Config.RMSNormEps,
 		)
 	}
+	return residual, nil
+}
 
-	residual = residual.Slice((seqLen-1)*uint32(l.Config.D), []uint32{1, uint32(l.Config.D)})
-	final_norm := tensor.RMSNorm(
-		residual,
-		l.Params.RMSOutW, // 最终层的归一化权重
-		l.Config.RMSNormEps,
-	)
-	logits := tensor.MatMulTransB(final_norm, l.Params.LMHead) // 输出投影层
-	if logits.Size() != uint32(l.Config.Vocab) {
-		panic("invalid logits size")
+// checkInput validates one sequence of a forward pass against the model
+// and its cache.
+func (l *Llama) checkInput(input []uint32, cache *kvcache.KVCache[float32], nLayers int) error {
+	if len(input) == 0 {
+		return fmt.Errorf("%w: empty input", ErrShapeMismatch)
+	}
+	if cache.NumLayers() < nLayers || cache.Dim() != uint32(l.Config.NKVH*l.Config.DQKV) {
+		return fmt.Errorf("%w: cache of %d layers of dimension %d, expected %d layers of dimension %d",
+			ErrShapeMismatch, cache.NumLayers(), cache.Dim(), nLayers, l.Config.NKVH*l.Config.DQKV)
 	}
-	return logits
+	for pos, tok := range input {
+		if tok >= uint32(l.Config.Vocab) {
+			return fmt.Errorf("%w: %d at position %d, vocabulary size is %d", ErrInvalidToken, tok, pos, l.Config.Vocab)
+		}
+	}
+	if n := int(cache.Len()) + len(input); n > int(cache.MaxSeqLen()) {
+		return &ContextOverflowError{Len: n, MaxSeqLen: int(cache.MaxSeqLen())}
+	}
+	return nil
+}
+
+// attention applies RoPE to rows [offset, offset+seqLen) of q and k, which
+// belong to one sequence, appends its keys and values to cache and writes
+// the attention output into the same rows of attnV.
+func (l *Llama) attention(layer int, cache *kvcache.KVCache[float32], pastSeqLen, offset, seqLen uint32, q, k, v, attnV *Tensor[float32]) error {
+	totalSeqLen := pastSeqLen + seqLen
+	qDim := uint32(l.Config.NQH * l.Config.DQKV)
+	kvDim := uint32(l.Config.NKVH * l.Config.DQKV)
+
+	qs := q.Slice(offset*qDim, []uint32{seqLen, uint32(l.Config.NQH), uint32(l.Config.DQKV)})
+	ks := k.Slice(offset*kvDim, []uint32{seqLen, uint32(l.Config.NKVH), uint32(l.Config.DQKV)})
+	vs := v.Slice(offset*kvDim, []uint32{seqLen, uint32(l.Config.NKVH), uint32(l.Config.DQKV)})
+	b := l.backend()
+	b.Rope(qs, pastSeqLen, l.Config.RopeTheta)
+	b.Rope(ks, pastSeqLen, l.Config.RopeTheta)
+
+	fullK, err := cache.KCache(uint32(layer), 0)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrShapeMismatch, err)
+	}
+	fullV, err := cache.VCache(uint32(layer), 0)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrShapeMismatch, err)
+	}
+
+	copy(fullK.Data()[pastSeqLen*kvDim:totalSeqLen*kvDim], ks.Data())
+	copy(fullV.Data()[pastSeqLen*kvDim:totalSeqLen*kvDim], vs.Data())
+
+	fullK.Reshape([]uint32{totalSeqLen, uint32(l.Config.NKVH), uint32(l.Config.DQKV)})
+	fullV.Reshape([]uint32{totalSeqLen, uint32(l.Config.NKVH), uint32(l.Config.DQKV)})
+
+	score, err := b.GroupAttnScore(qs, fullK)
+	if err != nil {
+		return fmt.Errorf("%w: attention scores: %v", ErrShapeMismatch, err)
+	}
+	out, err := b.GroupAttnV(score, fullV)
+	if err != nil {
+		return fmt.Errorf("%w: attention output: %v", ErrShapeMismatch, err)
+	}
+	copy(attnV.Data()[offset*qDim:(offset+seqLen)*qDim], out.Data())
+	return nil
 }
 
 func FFN(residual, wUp, wDown, wGate, rmsW *Tensor[float32], eps float32) *Tensor[float32] {
-	hidden := tensor.RMSNorm(residual, rmsW, eps)
-	gate := tensor.MatMulTransB(hidden, wGate)
+	return ffn(tensor.ReferenceBackend{}, residual, wUp, wDown, wGate, rmsW, eps)
+}
+
+func ffn(b tensor.Backend, residual *Tensor[float32], wUp, wDown, wGate tensor.Matrix, rmsW *Tensor[float32], eps float32) *Tensor[float32] {
+	hidden := b.RMSNorm(residual, rmsW, eps)
+	gate := b.MatMulTransB(hidden, wGate)
 
-	up := tensor.MatMulTransB(hidden, wUp)
-	tensor.SwiGLu(up, gate)
-	output := tensor.MatMulTransB(up, wDown)
-	return tensor.Add(residual, output)
+	up := b.MatMulTransB(hidden, wUp)
+	b.SwiGLU(up, gate)
+	output := b.MatMulTransB(up, wDown)
+	return b.Add(residual, output)
 }
@@ -1,8 +1,12 @@
 package model
 
 import (
+	"errors"
+	"fmt"
+	"learning-lm-go/kvcache"
 	"learning-lm-go/tensor"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"testing"
 )
@@ -98,12 +102,12 @@ func TestLoadSafetensors(t *testing.T) {
 		params := model.Params
 
 		// Embedding layer validation
-		if !tensor.FloatEq(params.EmbeddingTable.Data()[50], 0.14453125, 1e-6) {
+		if !tensor.FloatEq(f32(params.EmbeddingTable).Data()[50], 0.14453125, 1e-6) {
 			t.Error("Embedding layer index 50 value mismatch")
 		}
 
 		// Weight sharing validation (lm_head should point to embedding_table)
-		if params.LMHead.Data()[10] != params.EmbeddingTable.Data()[10] {
+		if f32(params.LMHead).Data()[10] != f32(params.EmbeddingTable).Data()[10] {
 			t.Error("lm_head and embedding_table don't share weights")
 		}
 
@@ -117,13 +121,13 @@ func TestLoadSafetensors(t *testing.T) {
 			{"RMSAttW[0]", params.RMSAttW[0].Data()[10], 0.18652344, 1e-6},
 			{"RMSFfnW[1]", params.RMSFfnW[1].Data()[10], 0.32421875, 1e-6},
 			{"RMSOutW", params.RMSOutW.Data()[100], 0.73046875, 1e-6},
-			{"WDown[0]", params.WDown[0].Data()[100], -0.0625, 1e-6},
-			{"WUp[0]", params.WUp[0].Data()[100], 1.46875, 1e-6},
-			{"WGate[1]", params.WGate[1].Data()[100], 0.296875, 1e-6},
-			{"WQ[1]", params.WQ[1].Data()[100], 0.032226563, 1e-6},
-			{"WK[1]", params.WK[1].Data()[100], -0.21386719, 1e-6},
-			{"WV[0]", params.WV[0].Data()[100], 0.041015625, 1e-6},
-			{"WO[0]", params.WO[0].Data()[100], 0.01965332, 1e-6},
+			{"WDown[0]", f32(params.WDown[0]).Data()[100], -0.0625, 1e-6},
+			{"WUp[0]", f32(params.WUp[0]).Data()[100], 1.46875, 1e-6},
+			{"WGate[1]", f32(params.WGate[1]).Data()[100], 0.296875, 1e-6},
+			{"WQ[1]", f32(params.WQ[1]).Data()[100], 0.032226563, 1e-6},
+			{"WK[1]", f32(params.WK[1]).Data()[100], -0.21386719, 1e-6},
+			{"WV[0]", f32(params.WV[0]).Data()[100], 0.041015625, 1e-6},
+			{"WO[0]", f32(params.WO[0]).Data()[100], 0.01965332, 1e-6},
 		}
 
 		for _, tc := range testCases {
@@ -134,6 +138,11 @@ func TestLoadSafetensors(t *testing.T) {
 	})
 }
 
+// f32 returns m as the float32 tensor the story model stores.
+func f32(m tensor.Matrix) *tensor.Tensor[float32] {
+	return m.(*tensor.Tensor[float32])
+}
+
 // assertEqual wraps integer assertions (common Go testing pattern)
 func assertEqual(t *testing.T, expected, actual int, msg string) {
 	t.Helper()
@@ -141,3 +150,180 @@ func assertEqual(t *testing.T, expected, actual int, msg string) {
 		t.Errorf("%s: expected %d, got %d", msg, expected, actual)
 	}
 }
+
+// loadStoryModel loads the story model shipped under models/story.
+func loadStoryModel(t testing.TB) *Llama {
+	t.Helper()
+	_, filename, _, _ := runtime.Caller(0)
+	projectDir := filepath.Dir(filepath.Dir(filename))
+	model, err := FromSafeTensors(filepath.Join(projectDir, "models", "story"))
+	if err != nil {
+		t.Fatalf("Failed to load model: %v", err)
+	}
+	return model
+}
+
+func TestGenerateWithParams(t *testing.T) {
+	model := loadStoryModel(t)
+	prompt := []uint32{1, 400, 500}
+
+	greedy, err := model.GenerateWithParams(prompt, 30, SamplingParams{})
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	greedyAgain, _ := model.GenerateWithParams(prompt, 30, SamplingParams{Seed: 7})
+	if !reflect.DeepEqual(greedy, greedyAgain) {
+		t.Errorf("Greedy decoding should not depend on the seed: %v vs %v", greedy, greedyAgain)
+	}
+
+	params := SamplingParams{Temperature: 1.0, TopK: 40, TopP: 0.9, Seed: 42}
+	a, _ := model.GenerateWithParams(prompt, 30, params)
+	b, _ := model.GenerateWithParams(prompt, 30, params)
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("Same seed should reproduce the same tokens: %v vs %v", a, b)
+	}
+	if !reflect.DeepEqual(a[:len(prompt)], prompt) {
+		t.Errorf("Output should start with the prompt, got %v", a)
+	}
+}
+
+func TestForwardAll(t *testing.T) {
+	model := loadStoryModel(t)
+	tokens := []uint32{1, 400, 500, 23, 97, 1024}
+	vocab := uint32(model.Config.Vocab)
+
+	cache, err := model.NewCache()
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	all, err := model.ForwardAll(tensor.NewTensor(tokens, []uint32{uint32(len(tokens))}), cache)
+	if err != nil {
+		t.Fatalf("ForwardAll failed: %v", err)
+	}
+	if !reflect.DeepEqual(all.Shape(), []uint32{uint32(len(tokens)), vocab}) {
+		t.Fatalf("Unexpected logits shape %v", all.Shape())
+	}
+
+	// every row must match feeding the tokens one at a time
+	stepCache, _ := model.NewCache()
+	for i, tok := range tokens {
+		step, err := model.Forward(tensor.NewTensor([]uint32{tok}, []uint32{1}), stepCache)
+		if err != nil {
+			t.Fatalf("Forward failed: %v", err)
+		}
+		row := all.Slice(uint32(i)*vocab, []uint32{1, vocab})
+		if ok, err := row.CloseTo(step, 1e-3); err != nil || !ok {
+			t.Errorf("Logits of position %d differ from incremental decoding", i)
+		}
+	}
+
+	// the default mode still returns the last row only
+	lastCache, _ := model.NewCache()
+	last, err := model.Forward(tensor.NewTensor(tokens, []uint32{uint32(len(tokens))}), lastCache)
+	if err != nil {
+		t.Fatalf("Forward failed: %v", err)
+	}
+	row := all.Slice(uint32(len(tokens)-1)*vocab, []uint32{1, vocab})
+	if ok, err := row.CloseTo(last, 1e-5); err != nil || !ok {
+		t.Errorf("Last row differs from Forward")
+	}
+}
+
+func TestForwardErrors(t *testing.T) {
+	model := loadStoryModel(t)
+	cache, err := model.NewCache()
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+
+	_, err = model.Forward(tensor.NewTensor([]uint32{1, uint32(model.Config.Vocab)}, []uint32{2}), cache)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken, got %v", err)
+	}
+	_, err = model.Forward(tensor.NewTensor([]uint32{}, []uint32{0}), cache)
+	if !errors.Is(err, ErrShapeMismatch) {
+		t.Errorf("Expected ErrShapeMismatch for an empty input, got %v", err)
+	}
+	small, _ := kvcache.NewKVCache[float32](1, 16, 8, 0)
+	_, err = model.Forward(tensor.NewTensor([]uint32{1}, []uint32{1}), small)
+	if !errors.Is(err, ErrShapeMismatch) {
+		t.Errorf("Expected ErrShapeMismatch for a foreign cache, got %v", err)
+	}
+	long := make([]uint32, model.Config.MaxSeqLen+1)
+	_, err = model.Forward(tensor.NewTensor(long, []uint32{uint32(len(long))}), cache)
+	var overflow *ContextOverflowError
+	if !errors.Is(err, ErrCapacityExceeded) || !errors.As(err, &overflow) {
+		t.Errorf("Expected ErrCapacityExceeded, got %v", err)
+	}
+	if cache.Len() != 0 {
+		t.Errorf("Rejected input must leave the cache untouched, it holds %d tokens", cache.Len())
+	}
+
+	// the cache is still usable
+	if _, err := model.Forward(tensor.NewTensor([]uint32{1, 400}, []uint32{2}), cache); err != nil {
+		t.Errorf("Forward failed after rejected input: %v", err)
+	}
+}
+
+// BenchmarkDecode measures decoding throughput for several MatMulTransB
+// worker counts.
+func BenchmarkDecode(b *testing.B) {
+	model := loadStoryModel(b)
+	defer tensor.SetMatMulWorkers(0)
+	const steps = 64
+	for workers := 1; workers <= max(runtime.GOMAXPROCS(0), 4); workers *= 2 {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			tensor.SetMatMulWorkers(workers)
+			for i := 0; i < b.N; i++ {
+				cache, _ := model.NewCache()
+				tok := uint32(1)
+				for step := 0; step < steps; step++ {
+					logits, err := model.Forward(tensor.NewTensor([]uint32{tok}, []uint32{1}), cache)
+					if err != nil {
+						b.Fatalf("Forward failed: %v", err)
+					}
+					tok = argmax(logits.Data())
+				}
+			}
+			b.ReportMetric(float64(b.N*steps)/b.Elapsed().Seconds(), "tokens/s")
+		})
+	}
+}
+
+// countingBackend counts the matrix multiplications it runs.
+type countingBackend struct {
+	tensor.ReferenceBackend
+	matMuls int
+}
+
+func (b *countingBackend) MatMulTransB(x *Tensor[float32], w tensor.Matrix) *Tensor[float32] {
+	b.matMuls++
+	return b.ReferenceBackend.MatMulTransB(x, w)
+}
+
+func TestBackend(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	dir := filepath.Join(filepath.Dir(filepath.Dir(filename)), "models", "story")
+	backend := &countingBackend{}
+	model, err := FromSafeTensors(dir, WithBackend(backend))
+	if err != nil {
+		t.Fatalf("Failed to load model: %v", err)
+	}
+	tokens := []uint32{1, 400, 500}
+	cache, _ := model.NewCache()
+	logits, err := model.Forward(tensor.NewTensor(tokens, []uint32{3}), cache)
+	if err != nil {
+		t.Fatalf("Forward failed: %v", err)
+	}
+	// q, k, v, o and three FFN projections per layer, then the LM head
+	if expected := 7*model.Config.NLayers + 1; backend.matMuls != expected {
+		t.Errorf("Expected %d matrix multiplications on the backend, got %d", expected, backend.matMuls)
+	}
+
+	reference := loadStoryModel(t)
+	refCache, _ := reference.NewCache()
+	expected, _ := reference.Forward(tensor.NewTensor(tokens, []uint32{3}), refCache)
+	if ok, err := logits.CloseTo(expected, 1e-6); err != nil || !ok {
+		t.Errorf("Logits differ from the reference backend")
+	}
+}
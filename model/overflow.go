@@ -0,0 +1,84 @@
+package model
+
+import (
+	"fmt"
+)
+
+// OverflowPolicy tells what generation does when the sequence no longer
+// fits in the model's context window of Config.MaxSeqLen tokens.
+type OverflowPolicy string
+
+const (
+	// OverflowError fails with a *ContextOverflowError. It is the default.
+	OverflowError OverflowPolicy = "error"
+	// OverflowTruncateLeft drops the oldest prompt tokens, after the first
+	// GenerateConfig.KeepTokens, so that the prompt and the tokens still to
+	// be generated fit. Generation that overflows anyway fails as with
+	// OverflowError.
+	OverflowTruncateLeft OverflowPolicy = "truncate_left"
+	// OverflowShift slides the window whenever it is full: the first
+	// KeepTokens are kept, half of the tokens after them are dropped and
+	// the rest are prefilled again at their new positions. Generation can
+	// then go on until MaxLen, seeing only the most recent context.
+	OverflowShift OverflowPolicy = "shift"
+)
+
+// ContextOverflowError is returned when a forward pass would take a
+// sequence beyond the maximum sequence length of the model.
+type ContextOverflowError struct {
+	Len       int // tokens the sequence would hold
+	MaxSeqLen int
+}
+
+func (e *ContextOverflowError) Error() string {
+	return fmt.Sprintf("context overflow: %d tokens exceed the maximum sequence length %d", e.Len, e.MaxSeqLen)
+}
+
+// Unwrap makes the error match ErrCapacityExceeded.
+func (e *ContextOverflowError) Unwrap() error {
+	return ErrCapacityExceeded
+}
+
+// fit applies the overflow policy before the next forward pass, so that
+// the cached tokens and the pending ones fit in the context window.
+func (s *sequence) fit() error {
+	cached := int(s.cache.Len())
+	need := cached + len(s.pending)
+	if need <= s.maxSeqLen {
+		return nil
+	}
+	overflow := &ContextOverflowError{Len: need, MaxSeqLen: s.maxSeqLen}
+	keep := s.cfg.KeepTokens
+	if keep >= s.maxSeqLen || (!s.prefilled && s.cfg.Echo) {
+		// nothing can be dropped, or the echoed prompt would be incomplete
+		return overflow
+	}
+
+	switch s.cfg.Overflow {
+	case OverflowTruncateLeft:
+		if s.prefilled {
+			return overflow
+		}
+		// leave room for the rest of the generation, but keep at least one
+		// token after the kept ones
+		budget := 0
+		if int(s.cfg.MaxLen) > len(s.result.Tokens) {
+			budget = int(s.cfg.MaxLen) - len(s.result.Tokens)
+		}
+		size := max(s.maxSeqLen-budget, keep+1)
+		s.pending = append(s.pending[:keep:keep], s.pending[len(s.pending)-(size-keep):]...)
+	case OverflowShift:
+		all := append(s.window[:cached:cached], s.pending...)
+		discard := max((len(all)-keep)/2, len(all)-s.maxSeqLen)
+		// the kept tokens that are already cached stay at their positions
+		reuse := min(keep, cached)
+		if err := s.cache.Truncate(uint32(reuse)); err != nil {
+			return err
+		}
+		s.window = s.window[:reuse]
+		s.pending = append(all[reuse:keep:keep], all[keep+discard:]...)
+	default:
+		return overflow
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// shortContext returns a copy of model whose context window holds only
+// maxSeqLen tokens.
+func shortContext(model *Llama, maxSeqLen int) *Llama {
+	config := *model.Config
+	config.MaxSeqLen = maxSeqLen
+	return &Llama{Config: &config, Params: model.Params}
+}
+
+func TestGenerateOverflow(t *testing.T) {
+	model := shortContext(loadStoryModel(t), 32)
+	prompt := make([]uint32, 40)
+	prompt[0] = 1
+	for i := 1; i < len(prompt); i++ {
+		prompt[i] = uint32(100 + 37*i)
+	}
+	sampling := SamplingParams{
+		Temperature: 0.8,
+		Seed:        5,
+		LogitBias:   map[uint32]float32{model.Config.EosTokenID: float32(math.Inf(-1))},
+	}
+
+	// the default policy fails with the partial result
+	result, err := model.GenerateContext(context.Background(), prompt[:10], GenerateConfig{MaxLen: 50, Sampling: sampling})
+	var overflow *ContextOverflowError
+	if !errors.As(err, &overflow) || overflow.MaxSeqLen != 32 {
+		t.Fatalf("Expected a ContextOverflowError, got %v", err)
+	}
+	if len(result.Tokens) != 33 {
+		t.Errorf("Expected generation to stop with 33 tokens, got %d", len(result.Tokens))
+	}
+	if _, err := model.GenerateContext(context.Background(), prompt, GenerateConfig{MaxLen: 50}); !errors.As(err, &overflow) {
+		t.Errorf("An overlong prompt should fail with a ContextOverflowError, got %v", err)
+	}
+
+	// truncation keeps BOS and the most recent 23 prompt tokens, leaving
+	// room for the 8 new ones
+	cfg := GenerateConfig{MaxLen: 48, Sampling: sampling, Overflow: OverflowTruncateLeft, KeepTokens: 1}
+	result, err = model.GenerateContext(context.Background(), prompt, cfg)
+	if err != nil {
+		t.Fatalf("Generation with truncation failed: %v", err)
+	}
+	truncated := append([]uint32{1}, prompt[len(prompt)-23:]...)
+	expected, err := model.GenerateContext(context.Background(), truncated, GenerateConfig{MaxLen: 32, Sampling: sampling})
+	if err != nil {
+		t.Fatalf("GenerateContext failed: %v", err)
+	}
+	if !reflect.DeepEqual(result.Tokens[len(prompt):], expected.Tokens[len(truncated):]) {
+		t.Errorf("Truncated generation differs:\n%v\n%v", result.Tokens[len(prompt):], expected.Tokens[len(truncated):])
+	}
+	if !reflect.DeepEqual(result.Tokens[:len(prompt)], prompt) {
+		t.Errorf("The result should hold the whole prompt")
+	}
+	cfg.MaxLen = 80
+	if _, err := model.GenerateContext(context.Background(), prompt, cfg); !errors.As(err, &overflow) {
+		t.Errorf("Truncation cannot make room for 40 new tokens, got %v", err)
+	}
+
+	// shifting goes on until MaxLen and matches the plain generation until
+	// the first shift
+	cfg = GenerateConfig{MaxLen: 100, Sampling: sampling, Overflow: OverflowShift, KeepTokens: 1}
+	result, err = model.GenerateContext(context.Background(), prompt[:10], cfg)
+	if err != nil {
+		t.Fatalf("Generation with shifting failed: %v", err)
+	}
+	if len(result.Tokens) != 100 || result.FinishReason != FinishLength {
+		t.Errorf("Expected 100 tokens, got %d (%s)", len(result.Tokens), result.FinishReason)
+	}
+	plain, _ := model.GenerateContext(context.Background(), prompt[:10], GenerateConfig{MaxLen: 33, Sampling: sampling})
+	if !reflect.DeepEqual(result.Tokens[:33], plain.Tokens) {
+		t.Errorf("Shifted generation differs before the first shift")
+	}
+}
+
+func TestBatchOverflow(t *testing.T) {
+	model := shortContext(loadStoryModel(t), 16)
+	prompt := make([]uint32, 24)
+	prompt[0] = 1
+	for i := 1; i < len(prompt); i++ {
+		prompt[i] = uint32(100 + 37*i)
+	}
+	noEOS := SamplingParams{LogitBias: map[uint32]float32{model.Config.EosTokenID: float32(math.Inf(-1))}}
+	sampled := noEOS
+	sampled.Temperature = 0.8
+	sampled.Seed = 5
+
+	for _, cfg := range []GenerateConfig{
+		{MaxLen: 30, Sampling: noEOS, Overflow: OverflowTruncateLeft, KeepTokens: 1},
+		{MaxLen: 40, Sampling: noEOS, Overflow: OverflowShift, KeepTokens: 1},
+		{MaxLen: 40, Sampling: sampled, Overflow: OverflowShift, KeepTokens: 2},
+	} {
+		name := fmt.Sprintf("%s/T=%v", cfg.Overflow, cfg.Sampling.Temperature)
+		prompts := [][]uint32{prompt, prompt[:20], prompt[:22]}
+		batch, err := model.GenerateBatch(context.Background(), prompts, []GenerateConfig{cfg}, nil)
+		if err != nil {
+			t.Fatalf("%s: GenerateBatch failed: %v", name, err)
+		}
+		for i, p := range prompts {
+			expected, err := model.GenerateContext(context.Background(), p, cfg)
+			if err != nil {
+				t.Fatalf("%s: GenerateContext failed: %v", name, err)
+			}
+			if !reflect.DeepEqual(batch[i].Tokens, expected.Tokens) {
+				t.Errorf("%s: sequence %d of the batch differs from single generation:\n%v\n%v", name, i, batch[i].Tokens, expected.Tokens)
+			}
+		}
+
+		// every sample starts from the fitted prompt and shifts its own window
+		samples, err := model.GenerateN(context.Background(), prompt[:20], cfg, 3, nil)
+		if err != nil {
+			t.Fatalf("%s: GenerateN failed: %v", name, err)
+		}
+		for i, sample := range samples {
+			single := cfg
+			single.Sampling.Seed += int64(i)
+			expected, err := model.GenerateContext(context.Background(), prompt[:20], single)
+			if err != nil {
+				t.Fatalf("%s: GenerateContext failed: %v", name, err)
+			}
+			if !reflect.DeepEqual(sample.Tokens, expected.Tokens) {
+				t.Errorf("%s: sample %d differs from single generation:\n%v\n%v", name, i, sample.Tokens, expected.Tokens)
+			}
+		}
+	}
+
+	if _, err := model.GenerateN(context.Background(), prompt, GenerateConfig{MaxLen: 30, KeepTokens: -1, Overflow: OverflowShift}, 2, nil); err == nil {
+		t.Errorf("A negative KeepTokens should be rejected")
+	}
+}
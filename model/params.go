@@ -14,41 +14,117 @@ import (
 	"strings"
 )
 
+// LlamaParams holds the weights of a model. The matrices keep the storage
+// format of the checkpoint (F32, F16 or BF16) or are quantized, see
+// tensor.Matrix; the normalisation weights are always T.
 type LlamaParams[T tensor.TensorDataType] struct {
 	// token_id到嵌入的查找表
-	EmbeddingTable *tensor.Tensor[T] // (vocab_size, dim)
+	EmbeddingTable tensor.Matrix // (vocab_size, dim)
 
 	// 解码器层参数
 	RMSAttW []*tensor.Tensor[T] // (hidden_size, ) 每层一个
-	WQ      []*tensor.Tensor[T] // (n_heads * head_size, hidden_size) 每层一个
-	WK      []*tensor.Tensor[T] // (n_kv_heads * head_size, hidden_size) 每层一个
-	WV      []*tensor.Tensor[T] // (n_kv_heads * head_size, hidden_size) 每层一个
-	WO      []*tensor.Tensor[T] // (hidden_size, n_heads * head_size) 每层一个
+	WQ      []tensor.Matrix     // (n_heads * head_size, hidden_size) 每层一个
+	WK      []tensor.Matrix     // (n_kv_heads * head_size, hidden_size) 每层一个
+	WV      []tensor.Matrix     // (n_kv_heads * head_size, hidden_size) 每层一个
+	WO      []tensor.Matrix     // (hidden_size, n_heads * head_size) 每层一个
 
 	// FFN层参数
 	RMSFfnW []*tensor.Tensor[T] // (hidden_size, ) 每层一个
-	WUp     []*tensor.Tensor[T] // (intermediate_size, hidden_size) 每层一个
-	WGate   []*tensor.Tensor[T] // (intermediate_size, hidden_size) 每层一个
-	WDown   []*tensor.Tensor[T] // (hidden_size, intermediate_size) 每层一个
+	WUp     []tensor.Matrix     // (intermediate_size, hidden_size) 每层一个
+	WGate   []tensor.Matrix     // (intermediate_size, hidden_size) 每层一个
+	WDown   []tensor.Matrix     // (hidden_size, intermediate_size) 每层一个
 
 	// 输出层参数
 	RMSOutW *tensor.Tensor[T] // (hidden_size, )
-	LMHead  *tensor.Tensor[T] // (vocab_size, dim)
+	LMHead  tensor.Matrix     // (vocab_size, dim)
 }
 
-func bytesToTypedSlice[T tensor.TensorDataType](dataBytes []byte, dtype string) ([]T, error) {
+// Bytes returns the memory taken by the weights; a matrix shared by two
+// fields, like a tied embedding table, counts once.
+func (p *LlamaParams[T]) Bytes() uint64 {
+	seen := make(map[tensor.Matrix]bool)
+	total := uint64(0)
+	add := func(m tensor.Matrix) {
+		if m == nil || seen[m] {
+			return
+		}
+		seen[m] = true
+		if q, ok := m.(*tensor.QTensor); ok {
+			total += q.Bytes()
+			return
+		}
+		total += uint64(m.Size()) * elementBytes(m)
+	}
+	add(p.EmbeddingTable)
+	add(p.LMHead)
+	add(p.RMSOutW)
+	for _, layer := range [][]tensor.Matrix{p.WQ, p.WK, p.WV, p.WO, p.WUp, p.WGate, p.WDown} {
+		for _, m := range layer {
+			add(m)
+		}
+	}
+	for _, layer := range [][]*tensor.Tensor[T]{p.RMSAttW, p.RMSFfnW} {
+		for _, w := range layer {
+			add(w)
+		}
+	}
+	return total
+}
+
+// elementBytes returns the size of an element of m.
+func elementBytes(m tensor.Matrix) uint64 {
+	switch m.(type) {
+	case *tensor.Tensor[tensor.F16], *tensor.Tensor[tensor.BF16]:
+		return 2
+	case *tensor.Tensor[float64], *tensor.Tensor[int64], *tensor.Tensor[uint64]:
+		return 8
+	}
+	return 4
+}
+
+// bytesToTypedSlice decodes little-endian tensor data. float32 accepts
+// F32, F16 and BF16 data, converting the 16-bit formats; F16 and BF16
+// accept their own format only.
+func bytesToTypedSlice[T tensor.ElementType](dataBytes []byte, dtype string) ([]T, error) {
 	var zero T
 	switch any(zero).(type) {
 	case float32:
-		if dtype != "F32" {
-			return nil, fmt.Errorf("dtype mismatch: expected F32, got %s", dtype)
+		switch dtype {
+		case "F32":
+			numElements := len(dataBytes) / 4
+			data := make([]T, numElements)
+			for i := 0; i < numElements; i++ {
+				bits := binary.LittleEndian.Uint32(dataBytes[i*4 : (i+1)*4])
+				val := float32(math.Float32frombits(bits))
+				data[i] = T(val)
+			}
+			return data, nil
+		case "F16", "BF16":
+			numElements := len(dataBytes) / 2
+			data := make([]T, numElements)
+			for i := 0; i < numElements; i++ {
+				bits := binary.LittleEndian.Uint16(dataBytes[i*2 : (i+1)*2])
+				if dtype == "F16" {
+					data[i] = T(tensor.F16(bits).Float32())
+				} else {
+					data[i] = T(tensor.BF16(bits).Float32())
+				}
+			}
+			return data, nil
+		}
+		return nil, fmt.Errorf("dtype mismatch: expected F32, F16 or BF16, got %s", dtype)
+	case tensor.F16, tensor.BF16:
+		want := "F16"
+		if _, ok := any(zero).(tensor.BF16); ok {
+			want = "BF16"
 		}
-		numElements := len(dataBytes) / 4
+		if dtype != want {
+			return nil, fmt.Errorf("dtype mismatch: expected %s, got %s", want, dtype)
+		}
+		numElements := len(dataBytes) / 2
 		data := make([]T, numElements)
 		for i := 0; i < numElements; i++ {
-			bits := binary.LittleEndian.Uint32(dataBytes[i*4 : (i+1)*4])
-			val := float32(math.Float32frombits(bits))
-			data[i] = T(val)
+			data[i] = T(binary.LittleEndian.Uint16(dataBytes[i*2 : (i+1)*2]))
 		}
 		return data, nil
 	// 扩展其他类型（如float64/int32等）
@@ -57,6 +133,53 @@ func bytesToTypedSlice[T tensor.TensorDataType](dataBytes []byte, dtype string)
 	}
 }
 
+// loadTensor decodes the data of a tensor. Matrices in F16 or BF16 stay in
+// 16 bits, everything else becomes float32.
+func loadTensor(buf []byte, dtype string, shape []uint32) (tensor.Matrix, error) {
+	if len(shape) == 2 {
+		switch dtype {
+		case "F16":
+			data, err := bytesToTypedSlice[tensor.F16](buf, dtype)
+			if err != nil {
+				return nil, err
+			}
+			return tensor.NewTensor(data, shape), nil
+		case "BF16":
+			data, err := bytesToTypedSlice[tensor.BF16](buf, dtype)
+			if err != nil {
+				return nil, err
+			}
+			return tensor.NewTensor(data, shape), nil
+		}
+	}
+	data, err := bytesToTypedSlice[float32](buf, dtype)
+	if err != nil {
+		return nil, err
+	}
+	return tensor.NewTensor(data, shape), nil
+}
+
+// quantizeMatrix quantizes a matrix to typ, or returns it unchanged if its
+// rows do not split into blocks.
+func quantizeMatrix(m tensor.Matrix, typ tensor.QuantType) (tensor.Matrix, error) {
+	shape := m.Shape()
+	if len(shape) != 2 || shape[1]%tensor.QuantBlockSize != 0 {
+		return m, nil
+	}
+	var weights *tensor.Tensor[float32]
+	switch m := m.(type) {
+	case *tensor.Tensor[float32]:
+		weights = m
+	case *tensor.Tensor[tensor.F16]:
+		weights = tensor.ToFloat32(m)
+	case *tensor.Tensor[tensor.BF16]:
+		weights = tensor.ToFloat32(m)
+	default:
+		return m, nil
+	}
+	return tensor.Quantize(weights, typ)
+}
+
 func extractLayerIndex(key string) (int, bool) {
 	re := regexp.MustCompile(`model\.layers\.(\d+)`)
 	matches := re.FindStringSubmatch(key)
@@ -68,6 +191,12 @@ func extractLayerIndex(key string) (int, bool) {
 }
 
 func ParamsFromSafeTensors(filePath string) (*LlamaParams[float32], error) {
+	return loadParams(filePath, "")
+}
+
+// loadParams reads the weights, quantizing the matrices to quant unless it
+// is empty.
+func loadParams(filePath string, quant tensor.QuantType) (*LlamaParams[float32], error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %v", err)
@@ -100,14 +229,14 @@ func ParamsFromSafeTensors(filePath string) (*LlamaParams[float32], error) {
 
 	params := &LlamaParams[float32]{
 		RMSAttW: make([]*tensor.Tensor[float32], totalLayers),
-		WQ:      make([]*tensor.Tensor[float32], totalLayers),
-		WK:      make([]*tensor.Tensor[float32], totalLayers),
-		WV:      make([]*tensor.Tensor[float32], totalLayers),
-		WO:      make([]*tensor.Tensor[float32], totalLayers),
+		WQ:      make([]tensor.Matrix, totalLayers),
+		WK:      make([]tensor.Matrix, totalLayers),
+		WV:      make([]tensor.Matrix, totalLayers),
+		WO:      make([]tensor.Matrix, totalLayers),
 		RMSFfnW: make([]*tensor.Tensor[float32], totalLayers),
-		WUp:     make([]*tensor.Tensor[float32], totalLayers),
-		WGate:   make([]*tensor.Tensor[float32], totalLayers),
-		WDown:   make([]*tensor.Tensor[float32], totalLayers),
+		WUp:     make([]tensor.Matrix, totalLayers),
+		WGate:   make([]tensor.Matrix, totalLayers),
+		WDown:   make([]tensor.Matrix, totalLayers),
 	}
 
 	dataStart := int64(8 + headerLen)
@@ -152,22 +281,25 @@ func ParamsFromSafeTensors(filePath string) (*LlamaParams[float32], error) {
 			continue
 		}
 
-		// 字节转泛型切片
-		dataSlice, err := bytesToTypedSlice[float32](buf, dtype)
+		// 字节转张量，16 位矩阵保持原格式
+		weight, err := loadTensor(buf, dtype, shape)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("tensor %s: %v", key, err)
+		}
+		vector, _ := weight.(*tensor.Tensor[float32])
+		if quant != "" {
+			if weight, err = quantizeMatrix(weight, quant); err != nil {
+				return nil, fmt.Errorf("tensor %s: %v", key, err)
+			}
 		}
-
-		// 创建张量
-		tensor := tensor.NewTensor(dataSlice, shape)
 
 		// 根据键名分配张量
 		switch {
 		case key == "lm_head.weight":
-			params.EmbeddingTable = tensor // 来自元数据映射
-			params.LMHead = tensor
+			params.EmbeddingTable = weight // 来自元数据映射
+			params.LMHead = weight
 		case key == "model.norm.weight":
-			params.RMSOutW = tensor
+			params.RMSOutW = vector
 		case strings.HasPrefix(key, "model.layers."):
 			layerIndex, ok := extractLayerIndex(key)
 			if !ok {
@@ -181,23 +313,23 @@ func ParamsFromSafeTensors(filePath string) (*LlamaParams[float32], error) {
 			suffix := strings.Join(parts[3:], ".")
 			switch suffix {
 			case "input_layernorm.weight":
-				params.RMSAttW[layerIndex] = tensor
+				params.RMSAttW[layerIndex] = vector
 			case "post_attention_layernorm.weight":
-				params.RMSFfnW[layerIndex] = tensor
+				params.RMSFfnW[layerIndex] = vector
 			case "self_attn.q_proj.weight":
-				params.WQ[layerIndex] = tensor
+				params.WQ[layerIndex] = weight
 			case "self_attn.k_proj.weight":
-				params.WK[layerIndex] = tensor
+				params.WK[layerIndex] = weight
 			case "self_attn.v_proj.weight":
-				params.WV[layerIndex] = tensor
+				params.WV[layerIndex] = weight
 			case "self_attn.o_proj.weight":
-				params.WO[layerIndex] = tensor
+				params.WO[layerIndex] = weight
 			case "mlp.gate_proj.weight":
-				params.WGate[layerIndex] = tensor
+				params.WGate[layerIndex] = weight
 			case "mlp.up_proj.weight":
-				params.WUp[layerIndex] = tensor
+				params.WUp[layerIndex] = weight
 			case "mlp.down_proj.weight":
-				params.WDown[layerIndex] = tensor
+				params.WDown[layerIndex] = weight
 			}
 		}
 	}
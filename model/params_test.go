@@ -0,0 +1,191 @@
+package model
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"learning-lm-go/tensor"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+// convertCheckpoint writes a copy of the story model with every tensor
+// stored as dtype ("F16" or "BF16") and returns its directory.
+func convertCheckpoint(t *testing.T, dtype string) string {
+	t.Helper()
+	_, filename, _, _ := runtime.Caller(0)
+	src := filepath.Join(filepath.Dir(filepath.Dir(filename)), "models", "story")
+	dst := t.TempDir()
+
+	config, err := os.ReadFile(filepath.Join(src, "config.json"))
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dst, "config.json"), config, 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(src, "model.safetensors"))
+	if err != nil {
+		t.Fatalf("Failed to read checkpoint: %v", err)
+	}
+	headerLen := binary.LittleEndian.Uint64(raw[:8])
+	var header map[string]json.RawMessage
+	if err := json.Unmarshal(raw[8:8+headerLen], &header); err != nil {
+		t.Fatalf("Failed to parse header: %v", err)
+	}
+	body := raw[8+headerLen:]
+
+	type entry struct {
+		DType   string   `json:"dtype"`
+		Shape   []uint32 `json:"shape"`
+		Offsets [2]int   `json:"data_offsets"`
+	}
+	entries := make(map[string]*entry)
+	var names []string
+	for name, value := range header {
+		if name == "__metadata__" {
+			continue
+		}
+		e := &entry{}
+		if err := json.Unmarshal(value, e); err != nil {
+			t.Fatalf("Failed to parse tensor %s: %v", name, err)
+		}
+		entries[name] = e
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var data []byte
+	for _, name := range names {
+		e := entries[name]
+		f32 := body[e.Offsets[0]:e.Offsets[1]]
+		start := len(data)
+		for i := 0; i+4 <= len(f32); i += 4 {
+			f := math.Float32frombits(binary.LittleEndian.Uint32(f32[i:]))
+			bits := uint16(tensor.BF16FromFloat32(f))
+			if dtype == "F16" {
+				bits = uint16(tensor.F16FromFloat32(f))
+			}
+			data = binary.LittleEndian.AppendUint16(data, bits)
+		}
+		e.DType = dtype
+		e.Offsets = [2]int{start, len(data)}
+	}
+	newHeader, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatalf("Failed to encode header: %v", err)
+	}
+	out := binary.LittleEndian.AppendUint64(nil, uint64(len(newHeader)))
+	out = append(append(out, newHeader...), data...)
+	if err := os.WriteFile(filepath.Join(dst, "model.safetensors"), out, 0o644); err != nil {
+		t.Fatalf("Failed to write checkpoint: %v", err)
+	}
+	return dst
+}
+
+func TestHalfPrecisionCheckpoint(t *testing.T) {
+	reference := loadStoryModel(t)
+	tokens := []uint32{1, 400, 500, 23, 97}
+	cache, _ := reference.NewCache()
+	expected, err := reference.Forward(tensor.NewTensor(tokens, []uint32{uint32(len(tokens))}), cache)
+	if err != nil {
+		t.Fatalf("Forward failed: %v", err)
+	}
+
+	for _, dtype := range []string{"F16", "BF16"} {
+		t.Run(dtype, func(t *testing.T) {
+			model, err := FromSafeTensors(convertCheckpoint(t, dtype))
+			if err != nil {
+				t.Fatalf("Failed to load %s checkpoint: %v", dtype, err)
+			}
+			switch model.Params.WQ[0].(type) {
+			case *tensor.Tensor[tensor.F16], *tensor.Tensor[tensor.BF16]:
+			default:
+				t.Errorf("Matrices should stay in 16 bits, got %T", model.Params.WQ[0])
+			}
+			if model.Params.RMSAttW[0] == nil || model.Params.RMSOutW == nil {
+				t.Fatalf("Normalisation weights should be converted to float32")
+			}
+			// the normalisation weights are the only float32 left
+			if ratio := float64(model.Params.Bytes()) / float64(reference.Params.Bytes()); ratio > 0.51 {
+				t.Errorf("%s weights take %.2f of the float32 memory", dtype, ratio)
+			}
+
+			cache, _ := model.NewCache()
+			logits, err := model.Forward(tensor.NewTensor(tokens, []uint32{uint32(len(tokens))}), cache)
+			if err != nil {
+				t.Fatalf("Forward failed: %v", err)
+			}
+			maxDiff, maxLogit := 0.0, 0.0
+			for i, v := range logits.Data() {
+				maxDiff = math.Max(maxDiff, math.Abs(float64(v-expected.Data()[i])))
+				maxLogit = math.Max(maxLogit, math.Abs(float64(expected.Data()[i])))
+			}
+			if maxDiff > 0.05*maxLogit {
+				t.Errorf("Logits differ by up to %v, the largest is %v", maxDiff, maxLogit)
+			}
+			if argmax(logits.Data()) != argmax(expected.Data()) {
+				t.Errorf("The most likely token changed")
+			}
+		})
+	}
+}
+
+func TestQuantizedModel(t *testing.T) {
+	reference := loadStoryModel(t)
+	story, err := reference.GenerateWithParams([]uint32{1, 400}, 200, SamplingParams{Temperature: 1, Seed: 3})
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	expected, err := reference.Perplexity(context.Background(), story, PerplexityConfig{})
+	if err != nil {
+		t.Fatalf("Perplexity failed: %v", err)
+	}
+	_, filename, _, _ := runtime.Caller(0)
+	modelDir := filepath.Join(filepath.Dir(filepath.Dir(filename)), "models", "story")
+
+	// maxLoss bounds the relative increase of the perplexity, maxRatio the
+	// memory taken compared with float32. The story model is small enough
+	// for 4 bits to cost it about 13% of perplexity, Q8_0 under 0.1%.
+	for _, c := range []struct {
+		typ      tensor.QuantType
+		maxLoss  float64
+		maxRatio float64
+	}{
+		{tensor.Q8_0, 0.01, 0.27},
+		{tensor.Q4_0, 0.20, 0.15},
+	} {
+		t.Run(string(c.typ), func(t *testing.T) {
+			model, err := FromSafeTensors(modelDir, WithQuantization(c.typ))
+			if err != nil {
+				t.Fatalf("Failed to load model: %v", err)
+			}
+			if q, ok := model.Params.WDown[0].(*tensor.QTensor); !ok || q.Type() != c.typ {
+				t.Fatalf("Matrices should be quantized to %s, got %T", c.typ, model.Params.WDown[0])
+			}
+			if model.Params.EmbeddingTable != model.Params.LMHead {
+				t.Errorf("The tied embedding table should stay shared")
+			}
+			ratio := float64(model.Params.Bytes()) / float64(reference.Params.Bytes())
+			if ratio > c.maxRatio {
+				t.Errorf("%s weights take %.3f of the float32 memory", c.typ, ratio)
+			}
+
+			result, err := model.Perplexity(context.Background(), story, PerplexityConfig{})
+			if err != nil {
+				t.Fatalf("Perplexity failed: %v", err)
+			}
+			loss := result.Perplexity/expected.Perplexity - 1
+			t.Logf("%s: perplexity %.4f vs %.4f for float32 (%+.2f%%), %.3f of the memory",
+				c.typ, result.Perplexity, expected.Perplexity, 100*loss, ratio)
+			if math.Abs(loss) > c.maxLoss {
+				t.Errorf("%s perplexity %v is too far from the float32 %v", c.typ, result.Perplexity, expected.Perplexity)
+			}
+		})
+	}
+}
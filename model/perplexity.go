@@ -0,0 +1,105 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"learning-lm-go/tensor"
+	"math"
+)
+
+// PerplexityConfig describes how a long token sequence is split into
+// windows the model can attend over.
+type PerplexityConfig struct {
+	// Window is the number of tokens per forward pass; 0 means MaxSeqLen.
+	Window uint32
+	// Stride is the distance between the starts of two windows. 0 or
+	// Window means Window-1, so that consecutive windows overlap by one
+	// token and the first token of a window is scored too; larger values
+	// are an error. With a smaller stride the windows overlap more, so
+	// every token after the first window is scored with at least
+	// Window-Stride tokens of context, at the cost of more forward passes.
+	Stride uint32
+}
+
+// PerplexityResult holds the likelihood of a token sequence.
+type PerplexityResult struct {
+	Tokens     int       // number of scored tokens, every one but the first
+	Windows    int       // number of forward passes
+	Window     uint32    // window size used, after the defaults
+	Stride     uint32    // stride used, after the defaults
+	NLL        float64   // summed negative log-likelihood in nats
+	MeanNLL    float64   // NLL per scored token
+	Perplexity float64   // exp(MeanNLL)
+	TokenNLL   []float32 // TokenNLL[i] is the NLL of tokens[i+1]
+}
+
+// BitsPerByte converts the likelihood into bits per byte of the text the
+// tokens were encoded from, which unlike perplexity does not depend on the
+// tokenizer.
+func (r *PerplexityResult) BitsPerByte(textBytes int) float64 {
+	if textBytes == 0 {
+		return 0
+	}
+	return r.NLL / math.Ln2 / float64(textBytes)
+}
+
+// Perplexity scores tokens with sliding windows. Each window is run
+// through ForwardAll on a fresh KV cache and only the tokens not scored
+// by an earlier window count, so every token after the first is scored
+// exactly once.
+func (l *Llama) Perplexity(ctx context.Context, tokens []uint32, cfg PerplexityConfig) (*PerplexityResult, error) {
+	if len(tokens) < 2 {
+		return nil, errors.New("perplexity needs at least two tokens")
+	}
+	window := cfg.Window
+	if window == 0 || window > uint32(l.Config.MaxSeqLen) {
+		window = uint32(l.Config.MaxSeqLen)
+	}
+	stride := cfg.Stride
+	if stride == 0 {
+		stride = window
+	}
+	if stride > window {
+		return nil, fmt.Errorf("stride %d exceeds window %d", stride, window)
+	}
+	if window < 2 {
+		return nil, errors.New("window must hold at least two tokens")
+	}
+	// the first token of a window is only scored by the one before
+	stride = min(stride, window-1)
+
+	cache, err := l.NewCache()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache: %v", err)
+	}
+	vocab := uint32(l.Config.Vocab)
+	result := &PerplexityResult{Window: window, Stride: stride, TokenNLL: make([]float32, 0, len(tokens)-1)}
+	n := uint32(len(tokens))
+	scored := uint32(1) // the first token has no context to be scored with
+
+	for begin := uint32(0); scored < n; begin += stride {
+		end := min(begin+window, n)
+		if err := cache.Truncate(0); err != nil {
+			return nil, err
+		}
+		logits, err := l.ForwardAllContext(ctx, tensor.NewTensor(tokens[begin:end], []uint32{end - begin}), cache)
+		if err != nil {
+			return nil, ctxError(ctx, err)
+		}
+		// row i predicts tokens[begin+i+1]
+		for pos := max(scored, begin+1); pos < end; pos++ {
+			row := logits.Slice((pos-begin-1)*vocab, []uint32{1, vocab})
+			nll := -newLogprobs(row.Data()).Of(tokens[pos])
+			result.TokenNLL = append(result.TokenNLL, nll)
+			result.NLL += float64(nll)
+		}
+		scored = end
+		result.Windows++
+	}
+
+	result.Tokens = len(result.TokenNLL)
+	result.MeanNLL = result.NLL / float64(result.Tokens)
+	result.Perplexity = math.Exp(result.MeanNLL)
+	return result, nil
+}
@@ -0,0 +1,76 @@
+package model
+
+import (
+	"context"
+	"learning-lm-go/tensor"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestPerplexity(t *testing.T) {
+	model := loadStoryModel(t)
+	story, err := model.GenerateWithParams([]uint32{1, 400}, 40, SamplingParams{Temperature: 0.8, Seed: 1})
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	// a single window must agree with scoring the tokens one at a time
+	result, err := model.Perplexity(context.Background(), story, PerplexityConfig{})
+	if err != nil {
+		t.Fatalf("Perplexity failed: %v", err)
+	}
+	if result.Tokens != len(story)-1 || result.Windows != 1 {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+	cache, _ := model.NewCache()
+	expected := float64(0)
+	for i := 0; i+1 < len(story); i++ {
+		logits, err := model.Forward(tensor.NewTensor(story[i:i+1], []uint32{1}), cache)
+		if err != nil {
+			t.Fatalf("Forward failed: %v", err)
+		}
+		expected -= float64(newLogprobs(logits.Data()).Of(story[i+1]))
+	}
+	if math.Abs(result.NLL-expected) > 1e-3*expected {
+		t.Errorf("NLL %v differs from incremental scoring %v", result.NLL, expected)
+	}
+	if math.Abs(result.Perplexity-math.Exp(expected/float64(len(story)-1))) > 1e-3*result.Perplexity {
+		t.Errorf("Perplexity %v does not match NLL", result.Perplexity)
+	}
+
+	// sliding windows score every token once; overlapping windows give
+	// more context and should not do much worse
+	windowed, err := model.Perplexity(context.Background(), story, PerplexityConfig{Window: 16, Stride: 8})
+	if err != nil {
+		t.Fatalf("Perplexity failed: %v", err)
+	}
+	if windowed.Tokens != len(story)-1 || windowed.Windows != 4 || windowed.Window != 16 || windowed.Stride != 8 {
+		t.Errorf("Unexpected windowed result: %d tokens in %d windows", windowed.Tokens, windowed.Windows)
+	}
+	disjoint, _ := model.Perplexity(context.Background(), story, PerplexityConfig{Window: 16})
+	if disjoint.Tokens != len(story)-1 || disjoint.Windows != 3 || disjoint.Stride != 15 {
+		t.Errorf("Disjoint windows scored %d tokens in %d windows with stride %d", disjoint.Tokens, disjoint.Windows, disjoint.Stride)
+	}
+	if disjoint.NLL < windowed.NLL {
+		t.Errorf("Disjoint windows (NLL %v) should not beat overlapping ones (NLL %v)", disjoint.NLL, windowed.NLL)
+	}
+
+	// the model's own samples are far more likely than random tokens
+	rng := rand.New(rand.NewSource(1))
+	random := make([]uint32, len(story))
+	for i := range random {
+		random[i] = uint32(3 + rng.Intn(model.Config.Vocab-3))
+	}
+	noise, _ := model.Perplexity(context.Background(), random, PerplexityConfig{})
+	if noise.Perplexity <= result.Perplexity {
+		t.Errorf("Random tokens (%v) should have a higher perplexity than a sample (%v)", noise.Perplexity, result.Perplexity)
+	}
+	if bpb := result.BitsPerByte(100); math.Abs(bpb-result.NLL/math.Ln2/100) > 1e-9 {
+		t.Errorf("Unexpected bits per byte %v", bpb)
+	}
+
+	if _, err := model.Perplexity(context.Background(), story, PerplexityConfig{Window: 8, Stride: 9}); err == nil {
+		t.Errorf("A stride larger than the window should be rejected")
+	}
+}
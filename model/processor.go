@@ -0,0 +1,217 @@
+package model
+
+import (
+	"learning-lm-go/tensor"
+)
+
+// LogitsProcessor rewrites the logits of the next token in place before a
+// Sampler picks from them. history holds the sequence so far, prompt
+// included. Masking a token is done by setting its logit to -inf.
+type LogitsProcessor interface {
+	Process(logits *Tensor[float32], history []uint32)
+}
+
+// LogitsProcessorFunc adapts an ordinary function to a LogitsProcessor.
+type LogitsProcessorFunc func(logits *Tensor[float32], history []uint32)
+
+func (f LogitsProcessorFunc) Process(logits *Tensor[float32], history []uint32) {
+	f(logits, history)
+}
+
+// ApplyProcessors runs every processor of chain on logits, in order.
+func ApplyProcessors(chain []LogitsProcessor, logits *Tensor[float32], history []uint32) {
+	for _, p := range chain {
+		p.Process(logits, history)
+	}
+}
+
+// lastTokens returns the last window tokens of history, or all of them when
+// window is 0.
+func lastTokens(history []uint32, window uint32) []uint32 {
+	if window > 0 && int(window) < len(history) {
+		return history[len(history)-int(window):]
+	}
+	return history
+}
+
+// TemperatureProcessor divides every logit by Temperature.
+type TemperatureProcessor struct {
+	Temperature float32
+}
+
+func (p TemperatureProcessor) Process(logits *Tensor[float32], history []uint32) {
+	if p.Temperature <= 0 || p.Temperature == 1 {
+		return
+	}
+	tensor.ScalarMul(1/p.Temperature, logits)
+}
+
+// TopKProcessor masks every logit outside the K largest.
+type TopKProcessor struct {
+	K uint32
+}
+
+func (p TopKProcessor) Process(logits *Tensor[float32], history []uint32) {
+	data := logits.Data()
+	if p.K == 0 || int(p.K) >= len(data) {
+		return
+	}
+	order := sortedIndices(data)
+	for _, idx := range order[p.K:] {
+		data[idx] = negInf
+	}
+}
+
+// TopPProcessor keeps the smallest set of most likely tokens whose
+// cumulative probability reaches P and masks the rest. The most likely token
+// is always kept.
+type TopPProcessor struct {
+	P float32
+}
+
+func (p TopPProcessor) Process(logits *Tensor[float32], history []uint32) {
+	if p.P <= 0 || p.P >= 1 {
+		return
+	}
+	data := logits.Data()
+	probs := softmax(data)
+	order := sortedIndices(data)
+
+	cum := float64(0)
+	cut := len(order)
+	for i, idx := range order {
+		cum += probs[idx]
+		if cum >= float64(p.P) {
+			cut = i + 1
+			break
+		}
+	}
+	for _, idx := range order[cut:] {
+		data[idx] = negInf
+	}
+}
+
+// MinPProcessor masks every token whose probability is below P times the
+// probability of the most likely token.
+type MinPProcessor struct {
+	P float32
+}
+
+func (p MinPProcessor) Process(logits *Tensor[float32], history []uint32) {
+	if p.P <= 0 {
+		return
+	}
+	data := logits.Data()
+	probs := softmax(data)
+	threshold := float64(p.P) * probs[argmax(data)]
+	for i, prob := range probs {
+		if prob < threshold {
+			data[i] = negInf
+		}
+	}
+}
+
+// LogitBiasProcessor adds a fixed bias to the logits of selected tokens.
+type LogitBiasProcessor struct {
+	Bias map[uint32]float32
+}
+
+func (p LogitBiasProcessor) Process(logits *Tensor[float32], history []uint32) {
+	data := logits.Data()
+	for tok, bias := range p.Bias {
+		if int(tok) < len(data) {
+			data[tok] += bias
+		}
+	}
+}
+
+// RepetitionPenaltyProcessor implements the CTRL repetition penalty: the
+// logit of every token among the last Window tokens is divided by Penalty
+// when positive and multiplied by it when negative.
+type RepetitionPenaltyProcessor struct {
+	Penalty float32
+	Window  uint32 // 0 means the whole history
+}
+
+func (p RepetitionPenaltyProcessor) Process(logits *Tensor[float32], history []uint32) {
+	if p.Penalty <= 0 || p.Penalty == 1 {
+		return
+	}
+	data := logits.Data()
+	window := lastTokens(history, p.Window)
+	seen := make(map[uint32]bool, len(window))
+	for _, tok := range window {
+		if seen[tok] || int(tok) >= len(data) {
+			continue
+		}
+		seen[tok] = true
+		if data[tok] > 0 {
+			data[tok] /= p.Penalty
+		} else {
+			data[tok] *= p.Penalty
+		}
+	}
+}
+
+// FrequencyPenaltyProcessor subtracts Frequency times the number of
+// occurrences of each token among the last Window tokens, plus Presence once
+// for every token present.
+type FrequencyPenaltyProcessor struct {
+	Frequency float32
+	Presence  float32
+	Window    uint32 // 0 means the whole history
+}
+
+func (p FrequencyPenaltyProcessor) Process(logits *Tensor[float32], history []uint32) {
+	if p.Frequency == 0 && p.Presence == 0 {
+		return
+	}
+	data := logits.Data()
+	window := lastTokens(history, p.Window)
+	counts := make(map[uint32]int, len(window))
+	for _, tok := range window {
+		counts[tok]++
+	}
+	for tok, n := range counts {
+		if int(tok) >= len(data) {
+			continue
+		}
+		data[tok] -= p.Frequency*float32(n) + p.Presence
+	}
+}
+
+// NoRepeatNGramProcessor masks every token that would complete an N-gram
+// already present among the last Window tokens.
+type NoRepeatNGramProcessor struct {
+	N      uint32
+	Window uint32 // 0 means the whole history
+}
+
+func (p NoRepeatNGramProcessor) Process(logits *Tensor[float32], history []uint32) {
+	size := int(p.N)
+	window := lastTokens(history, p.Window)
+	if size == 0 || len(window) < size {
+		return
+	}
+	data := logits.Data()
+	prefix := window[len(window)-size+1:]
+	for start := 0; start+size <= len(window); start++ {
+		if equalTokens(window[start:start+size-1], prefix) {
+			if banned := window[start+size-1]; int(banned) < len(data) {
+				data[banned] = negInf
+			}
+		}
+	}
+}
+
+func equalTokens(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
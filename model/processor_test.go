@@ -0,0 +1,107 @@
+package model
+
+import (
+	"learning-lm-go/tensor"
+	"math"
+	"testing"
+)
+
+// maskedAt reports which logits were set to -inf.
+func maskedAt(data []float32) []bool {
+	masked := make([]bool, len(data))
+	for i, v := range data {
+		masked[i] = math.IsInf(float64(v), -1)
+	}
+	return masked
+}
+
+func checkMasked(t *testing.T, name string, logits *Tensor[float32], expected []bool) {
+	t.Helper()
+	for i, m := range maskedAt(logits.Data()) {
+		if m != expected[i] {
+			t.Errorf("%s: unexpected mask at %d: %v", name, i, logits.Data())
+			return
+		}
+	}
+}
+
+func TestTopKProcessor(t *testing.T) {
+	logits := tensor.NewTensor([]float32{1, 4, 2, 3}, []uint32{4})
+	TopKProcessor{K: 2}.Process(logits, nil)
+	checkMasked(t, "TopK", logits, []bool{true, false, true, false})
+}
+
+func TestTopPProcessor(t *testing.T) {
+	// probabilities are roughly 0.64, 0.24, 0.09, 0.03
+	logits := tensor.NewTensor([]float32{3, 2, 1, 0}, []uint32{4})
+	TopPProcessor{P: 0.8}.Process(logits, nil)
+	checkMasked(t, "TopP", logits, []bool{false, false, true, true})
+
+	// the most likely token always survives
+	logits = tensor.NewTensor([]float32{3, 2, 1, 0}, []uint32{4})
+	TopPProcessor{P: 0.01}.Process(logits, nil)
+	checkMasked(t, "TopP", logits, []bool{false, true, true, true})
+}
+
+func TestMinPProcessor(t *testing.T) {
+	// relative to the top token: 1, 0.37, 0.14, 0.05
+	logits := tensor.NewTensor([]float32{3, 2, 1, 0}, []uint32{4})
+	MinPProcessor{P: 0.1}.Process(logits, nil)
+	checkMasked(t, "MinP", logits, []bool{false, false, false, true})
+}
+
+func TestTemperatureAndBias(t *testing.T) {
+	logits := tensor.NewTensor([]float32{2, -2, 1, 0.5}, []uint32{4})
+	ApplyProcessors([]LogitsProcessor{
+		LogitBiasProcessor{Bias: map[uint32]float32{1: 3}},
+		TemperatureProcessor{Temperature: 0.5},
+	}, logits, nil)
+	expected := tensor.NewTensor([]float32{4, 2, 2, 1}, []uint32{4})
+	if ok, _ := logits.CloseTo(expected, 1e-6); !ok {
+		t.Errorf("Bias and temperature: expected %v, got %v", expected, logits)
+	}
+}
+
+func TestPenaltyProcessors(t *testing.T) {
+	logits := tensor.NewTensor([]float32{2, -2, 1, 0.5}, []uint32{4})
+	RepetitionPenaltyProcessor{Penalty: 2}.Process(logits, []uint32{0, 1, 0})
+	expected := tensor.NewTensor([]float32{1, -4, 1, 0.5}, []uint32{4})
+	if ok, _ := logits.CloseTo(expected, 1e-6); !ok {
+		t.Errorf("Repetition penalty: expected %v, got %v", expected, logits)
+	}
+
+	logits = tensor.NewTensor([]float32{2, -2, 1, 0.5}, []uint32{4})
+	FrequencyPenaltyProcessor{Frequency: 0.5, Presence: 0.25}.Process(logits, []uint32{0, 2, 0})
+	expected = tensor.NewTensor([]float32{0.75, -2, 0.25, 0.5}, []uint32{4})
+	if ok, _ := logits.CloseTo(expected, 1e-6); !ok {
+		t.Errorf("Frequency penalty: expected %v, got %v", expected, logits)
+	}
+
+	// the window only sees the last token
+	logits = tensor.NewTensor([]float32{2, -2, 1, 0.5}, []uint32{4})
+	FrequencyPenaltyProcessor{Frequency: 1, Window: 1}.Process(logits, []uint32{0, 0, 2})
+	expected = tensor.NewTensor([]float32{2, -2, 0, 0.5}, []uint32{4})
+	if ok, _ := logits.CloseTo(expected, 1e-6); !ok {
+		t.Errorf("Windowed penalty: expected %v, got %v", expected, logits)
+	}
+}
+
+func TestNoRepeatNGramProcessor(t *testing.T) {
+	// "1 2 3 1 2" must not continue with 3
+	logits := tensor.NewTensor([]float32{0, 0, 0, 5}, []uint32{4})
+	NoRepeatNGramProcessor{N: 3}.Process(logits, []uint32{1, 2, 3, 1, 2})
+	checkMasked(t, "NoRepeatNGram", logits, []bool{false, false, false, true})
+}
+
+func TestLogitsProcessorFunc(t *testing.T) {
+	banOdd := LogitsProcessorFunc(func(logits *Tensor[float32], history []uint32) {
+		for i := 1; i < len(logits.Data()); i += 2 {
+			logits.Data()[i] = negInf
+		}
+	})
+	logits := tensor.NewTensor([]float32{0, 9, 1, 9}, []uint32{4})
+	ApplyProcessors([]LogitsProcessor{banOdd}, logits, nil)
+	if got := (GreedySampler{}).Sample(logits); got != 2 {
+		t.Errorf("Expected custom rule to steer greedy sampling to 2, got %d", got)
+	}
+}
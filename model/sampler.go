@@ -0,0 +1,196 @@
+package model
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Sampler picks the next token from logits that have already been through
+// the LogitsProcessor chain.
+type Sampler interface {
+	Sample(logits *Tensor[float32]) uint32
+}
+
+// GreedySampler always picks the most likely token.
+type GreedySampler struct{}
+
+func (GreedySampler) Sample(logits *Tensor[float32]) uint32 {
+	return argmax(logits.Data())
+}
+
+// RandomSampler draws a token from softmax(logits).
+type RandomSampler struct {
+	rng *rand.Rand
+}
+
+// NewRandomSampler returns a RandomSampler whose random source is seeded
+// with seed, so the same seed reproduces the same draws.
+func NewRandomSampler(seed int64) *RandomSampler {
+	return &RandomSampler{rng: rand.New(rand.NewSource(seed))}
+}
+
+func (s *RandomSampler) Sample(logits *Tensor[float32]) uint32 {
+	return sampleLogits(logits.Data(), s.rng)
+}
+
+// SamplingParams is a shorthand for the built-in processors and samplers.
+//
+// The processors are applied in a fixed order: logit bias, penalties,
+// temperature scaling, top-k truncation, nucleus (top-p) filtering, then
+// min-p filtering. A Temperature of 0 selects greedy (argmax) decoding of
+// the biased and penalised logits and ignores the remaining filters.
+type SamplingParams struct {
+	Temperature float32 // <= 0 means greedy decoding
+	TopK        uint32  // 0 disables top-k truncation
+	TopP        float32 // <= 0 or >= 1 disables nucleus filtering
+	MinP        float32 // 0 disables min-p filtering
+	Seed        int64   // seed of the sampler's random source
+
+	LogitBias map[uint32]float32 // added to the logits of the given tokens
+
+	// Penalties look at the last PenaltyWindow tokens of the sequence,
+	// prompt included; 0 means the whole sequence.
+	PenaltyWindow     uint32
+	RepetitionPenalty float32 // CTRL-style; 0 or 1 disables it
+	FrequencyPenalty  float32 // subtracted once per occurrence
+	PresencePenalty   float32 // subtracted once if the token occurred
+	NoRepeatNGramSize uint32  // bans tokens completing a repeated n-gram; 0 disables it
+}
+
+// Greedy reports whether the parameters select argmax decoding.
+func (p SamplingParams) Greedy() bool {
+	return p.Temperature <= 0
+}
+
+// Processors returns the processor chain described by p. Disabled
+// processors are left out.
+func (p SamplingParams) Processors() []LogitsProcessor {
+	chain := []LogitsProcessor{}
+	if len(p.LogitBias) > 0 {
+		chain = append(chain, LogitBiasProcessor{Bias: p.LogitBias})
+	}
+	if p.RepetitionPenalty > 0 && p.RepetitionPenalty != 1 {
+		chain = append(chain, RepetitionPenaltyProcessor{Penalty: p.RepetitionPenalty, Window: p.PenaltyWindow})
+	}
+	if p.FrequencyPenalty != 0 || p.PresencePenalty != 0 {
+		chain = append(chain, FrequencyPenaltyProcessor{
+			Frequency: p.FrequencyPenalty,
+			Presence:  p.PresencePenalty,
+			Window:    p.PenaltyWindow,
+		})
+	}
+	if p.NoRepeatNGramSize > 0 {
+		chain = append(chain, NoRepeatNGramProcessor{N: p.NoRepeatNGramSize, Window: p.PenaltyWindow})
+	}
+	if p.Greedy() {
+		return chain
+	}
+	if p.Temperature != 1 {
+		chain = append(chain, TemperatureProcessor{Temperature: p.Temperature})
+	}
+	if p.TopK > 0 {
+		chain = append(chain, TopKProcessor{K: p.TopK})
+	}
+	if p.TopP > 0 && p.TopP < 1 {
+		chain = append(chain, TopPProcessor{P: p.TopP})
+	}
+	if p.MinP > 0 {
+		chain = append(chain, MinPProcessor{P: p.MinP})
+	}
+	return chain
+}
+
+// Sampler returns GreedySampler for greedy decoding and a RandomSampler
+// seeded with p.Seed otherwise.
+func (p SamplingParams) Sampler() Sampler {
+	if p.Greedy() {
+		return GreedySampler{}
+	}
+	return NewRandomSampler(p.Seed)
+}
+
+// argmax returns the index of the largest value, preferring the lowest index on ties.
+func argmax(data []float32) uint32 {
+	maxIdx := uint32(0)
+	for i := 1; i < len(data); i++ {
+		if data[i] > data[maxIdx] {
+			maxIdx = uint32(i)
+		}
+	}
+	return maxIdx
+}
+
+var negInf = float32(math.Inf(-1))
+
+// sampleLogits draws an index from softmax(logits) using rng.
+func sampleLogits(data []float32, rng *rand.Rand) uint32 {
+	return sampleProbs(softmax(data), rng)
+}
+
+// sampleProbs draws an index from the distribution probs using rng.
+func sampleProbs(probs []float64, rng *rand.Rand) uint32 {
+	r := rng.Float64()
+	cum := float64(0)
+	last := uint32(0)
+	for i, p := range probs {
+		if p == 0 {
+			continue
+		}
+		cum += p
+		last = uint32(i)
+		if r < cum {
+			return last
+		}
+	}
+	// rounding may leave cum slightly below 1
+	return last
+}
+
+// softmax returns the normalised probabilities of data in float64.
+// Entries equal to -inf get probability 0. If every entry is -inf, the
+// whole mass goes to argmax(data), the token a greedy sampler would pick.
+func softmax(data []float32) []float64 {
+	best := argmax(data)
+	maxVal := data[best]
+	probs := make([]float64, len(data))
+	sum := float64(0)
+	for i, v := range data {
+		if math.IsInf(float64(v), -1) {
+			continue
+		}
+		probs[i] = math.Exp(float64(v - maxVal))
+		sum += probs[i]
+	}
+	if sum == 0 {
+		probs[best] = 1
+		return probs
+	}
+	for i := range probs {
+		probs[i] /= sum
+	}
+	return probs
+}
+
+// logSumExp returns log(sum(exp(data))) computed in a numerically stable way.
+func logSumExp(data []float32) float64 {
+	maxVal := float64(data[argmax(data)])
+	sum := float64(0)
+	for _, v := range data {
+		sum += math.Exp(float64(v) - maxVal)
+	}
+	return maxVal + math.Log(sum)
+}
+
+// sortedIndices returns the indices of data ordered by descending value.
+// The sort is stable so ties keep their vocabulary order.
+func sortedIndices(data []float32) []uint32 {
+	order := make([]uint32, len(data))
+	for i := range order {
+		order[i] = uint32(i)
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return data[order[a]] > data[order[b]]
+	})
+	return order
+}
@@ -0,0 +1,78 @@
+package model
+
+import (
+	"learning-lm-go/tensor"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestSampleLogits(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	inf := float32(math.Inf(-1))
+	data := []float32{inf, 0, inf, 0}
+	counts := make([]int, len(data))
+	for i := 0; i < 1000; i++ {
+		counts[sampleLogits(data, rng)]++
+	}
+	if counts[0] != 0 || counts[2] != 0 {
+		t.Errorf("Masked tokens were sampled: %v", counts)
+	}
+	if counts[1] < 400 || counts[3] < 400 {
+		t.Errorf("Expected a roughly even split, got %v", counts)
+	}
+
+	// a fully masked row falls back to the greedy choice instead of NaNs
+	masked := []float32{inf, inf, inf}
+	if probs := softmax(masked); !reflect.DeepEqual(probs, []float64{1, 0, 0}) {
+		t.Errorf("Expected the mass on the first token, got %v", probs)
+	}
+	if got := sampleLogits(masked, rng); got != 0 {
+		t.Errorf("Sampled %d from a fully masked row, expected 0", got)
+	}
+}
+
+func TestGreedySampler(t *testing.T) {
+	logits := tensor.NewTensor([]float32{0.1, 0.5, 0.5, 0.2}, []uint32{4})
+	if got := (GreedySampler{}).Sample(logits); got != 1 {
+		t.Errorf("Greedy sample: expected 1, got %d", got)
+	}
+}
+
+func TestSamplingParamsProcessors(t *testing.T) {
+	greedy := SamplingParams{TopK: 1, TopP: 0.5, RepetitionPenalty: 1.2}
+	chain := greedy.Processors()
+	if len(chain) != 1 {
+		t.Fatalf("Greedy decoding should only keep the penalty, got %v", chain)
+	}
+	if _, ok := greedy.Sampler().(GreedySampler); !ok {
+		t.Errorf("Expected a GreedySampler, got %T", greedy.Sampler())
+	}
+
+	params := SamplingParams{
+		Temperature:       0.7,
+		TopK:              10,
+		TopP:              0.9,
+		MinP:              0.05,
+		LogitBias:         map[uint32]float32{1: -1},
+		FrequencyPenalty:  0.1,
+		NoRepeatNGramSize: 3,
+	}
+	var kinds []string
+	for _, p := range params.Processors() {
+		kinds = append(kinds, reflect.TypeOf(p).Name())
+	}
+	expected := []string{
+		"LogitBiasProcessor",
+		"FrequencyPenaltyProcessor",
+		"NoRepeatNGramProcessor",
+		"TemperatureProcessor",
+		"TopKProcessor",
+		"TopPProcessor",
+		"MinPProcessor",
+	}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("Unexpected processor chain %v", kinds)
+	}
+}
@@ -0,0 +1,74 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"learning-lm-go/tensor"
+)
+
+// ScoreResult is the loglikelihood of a continuation given its context, as
+// in the loglikelihood requests of lm-evaluation-harness.
+type ScoreResult struct {
+	Logprob       float64   // summed logprob of the continuation tokens
+	IsGreedy      bool      // every continuation token is the most likely one
+	TokenLogprobs []float32 // logprob of each continuation token
+}
+
+// Score returns the loglikelihood of continuation following prefix. The
+// prefix must hold at least one token, e.g. BOS.
+func (l *Llama) Score(ctx context.Context, prefix, continuation []uint32) (*ScoreResult, error) {
+	results, err := l.ScoreBatch(ctx, prefix, [][]uint32{continuation})
+	if err != nil {
+		return nil, err
+	}
+	return &results[0], nil
+}
+
+// ScoreBatch scores several continuations of the same prefix, such as the
+// choices of a multiple-choice question. The prefix is run through the
+// model once; its KV cache is rolled back to the prefix after each
+// continuation instead of being recomputed.
+func (l *Llama) ScoreBatch(ctx context.Context, prefix []uint32, continuations [][]uint32) ([]ScoreResult, error) {
+	if len(prefix) == 0 {
+		return nil, errors.New("scoring needs a non-empty prefix")
+	}
+	cache, err := l.NewCache()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache: %v", err)
+	}
+	// the last prefix token goes with each continuation, its logits score
+	// the first continuation token
+	shared := prefix[:len(prefix)-1]
+	if len(shared) > 0 {
+		if _, err := l.ForwardContext(ctx, tensor.NewTensor(shared, []uint32{uint32(len(shared))}), cache); err != nil {
+			return nil, ctxError(ctx, err)
+		}
+	}
+
+	vocab := uint32(l.Config.Vocab)
+	results := make([]ScoreResult, len(continuations))
+	for i, cont := range continuations {
+		if len(cont) == 0 {
+			return nil, fmt.Errorf("continuation %d is empty", i)
+		}
+		if err := cache.Truncate(uint32(len(shared))); err != nil {
+			return nil, err
+		}
+		input := append([]uint32{prefix[len(prefix)-1]}, cont[:len(cont)-1]...)
+		logits, err := l.ForwardAllContext(ctx, tensor.NewTensor(input, []uint32{uint32(len(input))}), cache)
+		if err != nil {
+			return nil, ctxError(ctx, err)
+		}
+
+		r := ScoreResult{IsGreedy: true, TokenLogprobs: make([]float32, len(cont))}
+		for j, tok := range cont {
+			row := logits.Slice(uint32(j)*vocab, []uint32{1, vocab}).Data()
+			r.TokenLogprobs[j] = newLogprobs(row).Of(tok)
+			r.Logprob += float64(r.TokenLogprobs[j])
+			r.IsGreedy = r.IsGreedy && argmax(row) == tok
+		}
+		results[i] = r
+	}
+	return results, nil
+}
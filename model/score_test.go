@@ -0,0 +1,63 @@
+package model
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestScore(t *testing.T) {
+	model := loadStoryModel(t)
+	prompt := []uint32{1, 400, 500}
+
+	greedy, err := model.GenerateWithParams(prompt, 12, SamplingParams{})
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	continuation := greedy[len(prompt):]
+
+	result, err := model.Score(context.Background(), prompt, continuation)
+	if err != nil {
+		t.Fatalf("Score failed: %v", err)
+	}
+	if !result.IsGreedy {
+		t.Errorf("The greedy continuation should be reported as greedy")
+	}
+	// the summed logprob must agree with the perplexity of the sequence
+	ppl, _ := model.Perplexity(context.Background(), greedy, PerplexityConfig{})
+	expected := float64(0)
+	for _, nll := range ppl.TokenNLL[len(prompt)-1:] {
+		expected -= float64(nll)
+	}
+	if math.Abs(result.Logprob-expected) > 1e-3*math.Abs(expected) {
+		t.Errorf("Logprob %v differs from %v", result.Logprob, expected)
+	}
+
+	// swapping two tokens makes the continuation less likely and not greedy
+	altered := append([]uint32(nil), continuation...)
+	altered[0], altered[1] = altered[1], altered[0]
+	choices := [][]uint32{altered, continuation, {2}}
+	batch, err := model.ScoreBatch(context.Background(), prompt, choices)
+	if err != nil {
+		t.Fatalf("ScoreBatch failed: %v", err)
+	}
+	if math.Abs(batch[1].Logprob-result.Logprob) > 1e-4*math.Abs(result.Logprob) {
+		t.Errorf("Batch score %v differs from single score %v", batch[1].Logprob, result.Logprob)
+	}
+	if batch[0].IsGreedy || batch[0].Logprob >= batch[1].Logprob {
+		t.Errorf("Altered continuation scored %+v against %+v", batch[0], batch[1])
+	}
+	for i, choice := range choices {
+		single, _ := model.Score(context.Background(), prompt, choice)
+		if math.Abs(single.Logprob-batch[i].Logprob) > 1e-4*math.Abs(single.Logprob) {
+			t.Errorf("Choice %d: batch score %v differs from single score %v", i, batch[i].Logprob, single.Logprob)
+		}
+	}
+
+	if _, err := model.Score(context.Background(), nil, continuation); err == nil {
+		t.Errorf("An empty prefix should be rejected")
+	}
+	if _, err := model.ScoreBatch(context.Background(), prompt, [][]uint32{{}}); err == nil {
+		t.Errorf("An empty continuation should be rejected")
+	}
+}
@@ -0,0 +1,300 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"learning-lm-go/kvcache"
+	"learning-lm-go/tensor"
+	"math/rand"
+)
+
+// SpeculativeConfig describes a speculative decoding request.
+type SpeculativeConfig struct {
+	MaxLen uint32 // maximum sequence length, prompt included
+	// Sampling is applied to the logits of both the draft and the target
+	// model. The penalties see the drafted tokens as part of the history.
+	Sampling SamplingParams
+	// NumDraft is the number of tokens proposed per step; 0 means 4.
+	NumDraft int
+
+	// MaxNGram and MinNGram bound the length of the suffix that
+	// GeneratePromptLookup looks up in the sequence; 0 means 3 and 1.
+	MaxNGram int
+	MinNGram int
+}
+
+// SpeculativeResult is the outcome of a speculative decoding request.
+type SpeculativeResult struct {
+	Tokens       []uint32 // the prompt followed by every generated token
+	FinishReason FinishReason
+
+	Steps    int // forward passes of the target model after the prefill
+	Drafted  int // tokens proposed by the drafter
+	Accepted int // proposed tokens kept by the target model
+}
+
+// drafter proposes tokens for the target model to verify.
+type drafter interface {
+	// draft proposes up to k tokens following seq. probs[i] is the
+	// distribution tokens[i] was drawn from, or nil when the guess is
+	// deterministic.
+	draft(ctx context.Context, seq []uint32, k int) (tokens []uint32, probs [][]float64, err error)
+}
+
+// GenerateSpeculative generates with l, using the smaller model draft to
+// propose NumDraft tokens at a time that l then checks in a single
+// Forward over all of them.
+//
+// Proposals are accepted with the rejection sampling rule of Leviathan et
+// al., so the output follows the same distribution as sampling from l
+// alone; with greedy sampling it is token for token the same. Rejected
+// tokens are rolled back from both KV caches. Both models must share the
+// tokenizer.
+func (l *Llama) GenerateSpeculative(ctx context.Context, draft *Llama, tokens []uint32, cfg SpeculativeConfig) (*SpeculativeResult, error) {
+	if draft.Config.Vocab != l.Config.Vocab {
+		return nil, fmt.Errorf("draft vocabulary size %d differs from %d", draft.Config.Vocab, l.Config.Vocab)
+	}
+	cache, err := draft.NewCache()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create draft cache: %v", err)
+	}
+	d := &modelDrafter{
+		l:      draft,
+		cache:  cache,
+		chain:  cfg.Sampling.Processors(),
+		greedy: cfg.Sampling.Greedy(),
+		// offset the seed so draft and target draws are independent
+		rng: rand.New(rand.NewSource(cfg.Sampling.Seed + 1)),
+	}
+	return l.speculate(ctx, d, tokens, cfg)
+}
+
+// GeneratePromptLookup is speculative decoding without a draft model:
+// the proposals are the tokens that followed the latest earlier
+// occurrence of the sequence's last n tokens, in the prompt or in the
+// generated text, trying the longest n first. It pays off when the output
+// repeats its input, as in summaries or story continuations that reuse
+// names and phrases. Verification is the same as in GenerateSpeculative,
+// so the output distribution is unchanged.
+func (l *Llama) GeneratePromptLookup(ctx context.Context, tokens []uint32, cfg SpeculativeConfig) (*SpeculativeResult, error) {
+	d := &ngramDrafter{maxN: cfg.MaxNGram, minN: cfg.MinNGram}
+	if d.maxN <= 0 {
+		d.maxN = 3
+	}
+	if d.minN <= 0 {
+		d.minN = 1
+	}
+	if d.minN > d.maxN {
+		return nil, fmt.Errorf("MinNGram %d exceeds MaxNGram %d", d.minN, d.maxN)
+	}
+	return l.speculate(ctx, d, tokens, cfg)
+}
+
+// speculate runs the draft-then-verify loop shared by the drafters.
+func (l *Llama) speculate(ctx context.Context, d drafter, tokens []uint32, cfg SpeculativeConfig) (*SpeculativeResult, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("speculative decoding needs a non-empty prompt")
+	}
+	numDraft := cfg.NumDraft
+	if numDraft <= 0 {
+		numDraft = 4
+	}
+	cache, err := l.NewCache()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache: %v", err)
+	}
+	chain := cfg.Sampling.Processors()
+	greedy := cfg.Sampling.Greedy()
+	rng := rand.New(rand.NewSource(cfg.Sampling.Seed))
+	vocab := uint32(l.Config.Vocab)
+
+	result := &SpeculativeResult{Tokens: append([]uint32(nil), tokens...)}
+	// the cache holds every token but the last, which is fed with the
+	// draft so its logits score the first proposed token
+	if len(tokens) > 1 {
+		prefix := tokens[:len(tokens)-1]
+		if _, err := l.ForwardContext(ctx, tensor.NewTensor(prefix, []uint32{uint32(len(prefix))}), cache); err != nil {
+			return result, ctxError(ctx, err)
+		}
+	}
+
+	for result.FinishReason == "" {
+		if err := ctx.Err(); err != nil {
+			return result, &CanceledError{Err: err}
+		}
+		seq := result.Tokens
+		k := min(numDraft, int(cfg.MaxLen)-len(seq)-1, l.Config.MaxSeqLen-len(seq))
+		var proposed []uint32
+		var q [][]float64
+		if k > 0 {
+			if proposed, q, err = d.draft(ctx, seq, k); err != nil {
+				return result, ctxError(ctx, err)
+			}
+		}
+
+		input := append([]uint32{seq[len(seq)-1]}, proposed...)
+		logits, err := l.ForwardAllContext(ctx, tensor.NewTensor(input, []uint32{uint32(len(input))}), cache)
+		if err != nil {
+			return result, ctxError(ctx, err)
+		}
+		p := make([][]float64, len(input))
+		for i := range input {
+			row := logits.Slice(uint32(i)*vocab, []uint32{1, vocab})
+			history := append(append([]uint32(nil), seq...), proposed[:i]...)
+			p[i] = distribution(chain, greedy, row, history)
+		}
+
+		accepted, next := acceptDraft(p, q, proposed, rng)
+		// keep the last token and the accepted proposals; next is fed
+		// with the following step
+		if err := cache.Truncate(uint32(len(seq) + accepted)); err != nil {
+			return result, err
+		}
+		result.Steps++
+		result.Drafted += len(proposed)
+		result.Accepted += accepted
+
+		for _, tok := range append(proposed[:accepted:accepted], next) {
+			result.Tokens = append(result.Tokens, tok)
+			if tok == l.Config.EosTokenID {
+				result.FinishReason = FinishEOS
+				break
+			}
+			if uint32(len(result.Tokens)) >= cfg.MaxLen {
+				result.FinishReason = FinishLength
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// distribution applies chain to logits and returns the distribution the
+// next token is sampled from, which is one-hot at the argmax for greedy
+// decoding.
+func distribution(chain []LogitsProcessor, greedy bool, logits *Tensor[float32], history []uint32) []float64 {
+	ApplyProcessors(chain, logits, history)
+	if greedy {
+		probs := make([]float64, logits.Size())
+		probs[argmax(logits.Data())] = 1
+		return probs
+	}
+	return softmax(logits.Data())
+}
+
+// acceptDraft verifies the proposed tokens against the target
+// distributions p, where p[i] scores position i and p[len(proposed)] the
+// position after the last proposal. Token i is kept with probability
+// min(1, p[i]/q[i]); at the first rejection the replacement is drawn from
+// max(0, p[i]-q[i]), normalised. When every token is kept, the next one
+// is drawn from the last target distribution.
+//
+// It returns the number of accepted proposals and the token that follows
+// them.
+func acceptDraft(p, q [][]float64, proposed []uint32, rng *rand.Rand) (int, uint32) {
+	for i, tok := range proposed {
+		draftProb := float64(1)
+		if q != nil && q[i] != nil {
+			draftProb = q[i][tok]
+		}
+		if draftProb > 0 && rng.Float64() < p[i][tok]/draftProb {
+			continue
+		}
+
+		residual := make([]float64, len(p[i]))
+		sum := float64(0)
+		for j, prob := range p[i] {
+			if q != nil && q[i] != nil {
+				prob -= q[i][j]
+			} else if uint32(j) == tok {
+				prob = 0
+			}
+			if prob > 0 {
+				residual[j] = prob
+				sum += prob
+			}
+		}
+		if sum == 0 {
+			// only reachable through rounding, fall back to the target
+			return i, sampleProbs(p[i], rng)
+		}
+		for j := range residual {
+			residual[j] /= sum
+		}
+		return i, sampleProbs(residual, rng)
+	}
+	return len(proposed), sampleProbs(p[len(proposed)], rng)
+}
+
+// modelDrafter proposes tokens by sampling from a smaller model. Its
+// cache is rolled back to the part of the sequence the target kept.
+type modelDrafter struct {
+	l      *Llama
+	cache  *kvcache.KVCache[float32]
+	cached []uint32 // tokens whose keys and values are in cache
+	chain  []LogitsProcessor
+	greedy bool
+	rng    *rand.Rand
+}
+
+func (d *modelDrafter) draft(ctx context.Context, seq []uint32, k int) ([]uint32, [][]float64, error) {
+	// keep at least the last token out of the cache so there is
+	// something to feed
+	common := min(commonPrefix(d.cached, seq), len(seq)-1)
+	if err := d.cache.Truncate(uint32(common)); err != nil {
+		return nil, nil, err
+	}
+	d.cached = append(d.cached[:common], seq[common:]...)
+	pending := seq[common:]
+
+	history := append([]uint32(nil), seq...)
+	var tokens []uint32
+	var probs [][]float64
+	for len(tokens) < k {
+		logits, err := d.l.ForwardContext(ctx, tensor.NewTensor(pending, []uint32{uint32(len(pending))}), d.cache)
+		if err != nil {
+			return nil, nil, err
+		}
+		q := distribution(d.chain, d.greedy, logits, history)
+		tok := sampleProbs(q, d.rng)
+		tokens = append(tokens, tok)
+		probs = append(probs, q)
+		history = append(history, tok)
+		if tok == d.l.Config.EosTokenID || len(tokens) == k {
+			break
+		}
+		pending = []uint32{tok}
+		d.cached = append(d.cached, tok)
+	}
+	return tokens, probs, nil
+}
+
+// ngramDrafter proposes the continuation of an earlier occurrence of the
+// sequence's suffix.
+type ngramDrafter struct {
+	maxN, minN int
+}
+
+func (d *ngramDrafter) draft(ctx context.Context, seq []uint32, k int) ([]uint32, [][]float64, error) {
+	for n := min(d.maxN, len(seq)-1); n >= d.minN; n-- {
+		suffix := seq[len(seq)-n:]
+		// the latest match wins, it is the most relevant context
+		for start := len(seq) - n - 1; start >= 0; start-- {
+			if equalTokens(seq[start:start+n], suffix) {
+				follow := seq[start+n : min(start+n+k, len(seq))]
+				return append([]uint32(nil), follow...), nil, nil
+			}
+		}
+	}
+	return nil, nil, nil
+}
+
+// commonPrefix returns the length of the longest common prefix of a and b.
+func commonPrefix(a, b []uint32) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,154 @@
+package model
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// shallowDraft returns a draft model that shares the weights of model but
+// only runs its first layer.
+func shallowDraft(model *Llama) *Llama {
+	config := *model.Config
+	config.NLayers = 1
+	return &Llama{Config: &config, Params: model.Params}
+}
+
+func TestGenerateSpeculativeGreedy(t *testing.T) {
+	model := loadStoryModel(t)
+	prompt := []uint32{1, 400, 500}
+
+	expected, err := model.GenerateWithParams(prompt, 60, SamplingParams{})
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		draft *Llama
+	}{
+		{"shallow", shallowDraft(model)},
+		{"self", model},
+	} {
+		result, err := model.GenerateSpeculative(context.Background(), tc.draft, prompt, SpeculativeConfig{MaxLen: 60, NumDraft: 3})
+		if err != nil {
+			t.Fatalf("%s: GenerateSpeculative failed: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(result.Tokens, expected) {
+			t.Errorf("%s: speculative output differs from greedy decoding:\n%v\n%v", tc.name, result.Tokens, expected)
+		}
+		if result.Accepted > result.Drafted || result.Steps >= len(expected)-len(prompt)+1 {
+			t.Errorf("%s: unexpected stats %+v", tc.name, result)
+		}
+		if tc.draft == model && result.Accepted != result.Drafted {
+			t.Errorf("%s: a model drafting for itself should always be accepted, got %+v", tc.name, result)
+		}
+		t.Logf("%s: %d tokens in %d steps, %d/%d drafted tokens accepted", tc.name,
+			len(result.Tokens)-len(prompt), result.Steps, result.Accepted, result.Drafted)
+	}
+}
+
+func TestGenerateSpeculativeSampling(t *testing.T) {
+	model := loadStoryModel(t)
+	prompt := []uint32{1, 400, 500}
+	cfg := SpeculativeConfig{MaxLen: 40, Sampling: SamplingParams{Temperature: 0.8, TopK: 20, Seed: 5}}
+
+	first, err := model.GenerateSpeculative(context.Background(), shallowDraft(model), prompt, cfg)
+	if err != nil {
+		t.Fatalf("GenerateSpeculative failed: %v", err)
+	}
+	second, err := model.GenerateSpeculative(context.Background(), shallowDraft(model), prompt, cfg)
+	if err != nil {
+		t.Fatalf("GenerateSpeculative failed: %v", err)
+	}
+	if !reflect.DeepEqual(first.Tokens, second.Tokens) {
+		t.Errorf("Same seed gave different outputs: %v vs %v", first.Tokens, second.Tokens)
+	}
+	if first.FinishReason == "" || len(first.Tokens) > int(cfg.MaxLen) {
+		t.Errorf("Unexpected result %+v", first)
+	}
+}
+
+func TestAcceptDraftDistribution(t *testing.T) {
+	// whatever the draft distribution, the first emitted token must
+	// follow the target distribution
+	p := []float64{0.5, 0.3, 0.2}
+	q := []float64{0.1, 0.2, 0.7}
+	rng := rand.New(rand.NewSource(1))
+	const trials = 50000
+
+	for _, deterministic := range []bool{false, true} {
+		counts := make([]int, len(p))
+		for n := 0; n < trials; n++ {
+			tok := sampleProbs(q, rng)
+			draftProbs := [][]float64{q}
+			if deterministic {
+				tok, draftProbs = 2, nil
+			}
+			accepted, next := acceptDraft([][]float64{p, p}, draftProbs, []uint32{tok}, rng)
+			if accepted == 1 {
+				next = tok
+			}
+			counts[next]++
+		}
+		for i, c := range counts {
+			if freq := float64(c) / trials; math.Abs(freq-p[i]) > 0.01 {
+				t.Errorf("deterministic=%v: token %d emitted with frequency %.3f, expected %.3f", deterministic, i, freq, p[i])
+			}
+		}
+	}
+}
+
+func TestNGramDrafter(t *testing.T) {
+	d := &ngramDrafter{maxN: 3, minN: 1}
+	for _, tc := range []struct {
+		seq      []uint32
+		expected []uint32
+	}{
+		// the longest suffix wins over a later but shorter match
+		{[]uint32{1, 2, 3, 9, 9, 7, 3, 5, 1, 2, 3}, []uint32{9, 9}},
+		// the latest occurrence wins among equal lengths
+		{[]uint32{4, 5, 6, 4, 7, 8, 4}, []uint32{7, 8}},
+		// proposals stop at the end of the sequence
+		{[]uint32{4, 5, 4}, []uint32{5, 4}},
+		{[]uint32{1, 2, 3}, nil},
+	} {
+		actual, probs, err := d.draft(context.Background(), tc.seq, 2)
+		if err != nil || probs != nil {
+			t.Fatalf("draft(%v) returned probs %v, err %v", tc.seq, probs, err)
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("draft(%v) = %v, expected %v", tc.seq, actual, tc.expected)
+		}
+	}
+}
+
+func TestGeneratePromptLookup(t *testing.T) {
+	model := loadStoryModel(t)
+	prompt := []uint32{1, 400, 500}
+
+	for _, params := range []SamplingParams{{}, {Temperature: 0.7, TopK: 40, Seed: 2}} {
+		expected, err := model.GenerateWithParams(prompt, 120, params)
+		if err != nil {
+			t.Fatalf("Generate failed: %v", err)
+		}
+		result, err := model.GeneratePromptLookup(context.Background(), prompt, SpeculativeConfig{MaxLen: 120, Sampling: params})
+		if err != nil {
+			t.Fatalf("GeneratePromptLookup failed: %v", err)
+		}
+		if params.Greedy() && !reflect.DeepEqual(result.Tokens, expected) {
+			t.Errorf("Prompt lookup output differs from greedy decoding:\n%v\n%v", result.Tokens, expected)
+		}
+		if len(result.Tokens) > 120 || result.Accepted > result.Drafted {
+			t.Errorf("Unexpected result %+v", result)
+		}
+		t.Logf("greedy=%v: %d tokens in %d steps, %d/%d drafted tokens accepted", params.Greedy(),
+			len(result.Tokens)-len(prompt), result.Steps, result.Accepted, result.Drafted)
+	}
+
+	if _, err := model.GeneratePromptLookup(context.Background(), prompt, SpeculativeConfig{MaxLen: 10, MinNGram: 4}); err == nil {
+		t.Errorf("MinNGram above MaxNGram should be rejected")
+	}
+}
@@ -0,0 +1,77 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Vocabulary holds the text of every token of a tokenizer, as needed by
+// constraints that have to know which characters a token produces.
+type Vocabulary struct {
+	// Tokens[i] is the UTF-8 (or, for byte fallback tokens, raw) text of
+	// token i. Special tokens have no text and are nil.
+	Tokens [][]byte
+}
+
+// LoadVocabulary reads the vocabulary of a BPE tokenizer.json. The "▁"
+// marker is turned back into a space and byte fallback tokens such as
+// <0x0A> into the byte they stand for.
+func LoadVocabulary(path string) (*Vocabulary, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tokenizer: %v", err)
+	}
+	var tk struct {
+		AddedTokens []struct {
+			ID      uint32 `json:"id"`
+			Special bool   `json:"special"`
+		} `json:"added_tokens"`
+		Model struct {
+			Vocab        map[string]uint32 `json:"vocab"`
+			ByteFallback bool              `json:"byte_fallback"`
+		} `json:"model"`
+	}
+	if err := json.Unmarshal(data, &tk); err != nil {
+		return nil, fmt.Errorf("failed to parse tokenizer: %v", err)
+	}
+
+	size := uint32(0)
+	for _, id := range tk.Model.Vocab {
+		size = max(size, id+1)
+	}
+	special := make(map[uint32]bool)
+	for _, t := range tk.AddedTokens {
+		size = max(size, t.ID+1)
+		if t.Special {
+			special[t.ID] = true
+		}
+	}
+
+	v := &Vocabulary{Tokens: make([][]byte, size)}
+	for piece, id := range tk.Model.Vocab {
+		if special[id] {
+			continue
+		}
+		if b, ok := byteFallback(piece); ok && tk.Model.ByteFallback {
+			v.Tokens[id] = []byte{b}
+			continue
+		}
+		v.Tokens[id] = []byte(strings.ReplaceAll(piece, "▁", " "))
+	}
+	return v, nil
+}
+
+// byteFallback parses a piece of the form <0xNN>.
+func byteFallback(piece string) (byte, bool) {
+	if len(piece) != 6 || !strings.HasPrefix(piece, "<0x") || piece[5] != '>' {
+		return 0, false
+	}
+	b, err := strconv.ParseUint(piece[3:5], 16, 8)
+	if err != nil {
+		return 0, false
+	}
+	return byte(b), true
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"learning-lm-go/model"
+	"os"
+	"os/signal"
+	"path"
+	"time"
+
+	"github.com/daulet/tokenizers"
+	"github.com/sirupsen/logrus"
+)
+
+// PerplexitySummary is the JSON report of the perplexity subcommand.
+type PerplexitySummary struct {
+	Model       string    `json:"model"`
+	File        string    `json:"file"`
+	Bytes       int       `json:"bytes"`
+	Tokens      int       `json:"tokens"`
+	Window      uint32    `json:"window"`
+	Stride      uint32    `json:"stride"`
+	Windows     int       `json:"windows"`
+	NLL         float64   `json:"nll"`
+	MeanNLL     float64   `json:"mean_nll"`
+	Perplexity  float64   `json:"perplexity"`
+	BitsPerByte float64   `json:"bits_per_byte"`
+	Seconds     float64   `json:"seconds"`
+	TokenNLL    []float32 `json:"token_nll,omitempty"`
+}
+
+// runPerplexity implements `perplexity [flags] FILE`: it scores the text
+// of FILE with the model and prints a JSON summary.
+func runPerplexity(args []string) {
+	fs := flag.NewFlagSet("perplexity", flag.ExitOnError)
+	modelDir := fs.String("model", "models/story", "model directory")
+	window := fs.Uint("window", 0, "tokens per window, 0 for the model's max_position_embeddings")
+	stride := fs.Uint("stride", 0, "distance between window starts, at most the window size less one token; 0 for the largest")
+	bos := fs.Bool("bos", true, "prepend the BOS token")
+	perToken := fs.Bool("per-token", false, "include the NLL of every token in the summary")
+	output := fs.String("o", "", "write the summary to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s perplexity [flags] FILE\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	file := fs.Arg(0)
+
+	llama, err := model.FromSafeTensors(*modelDir)
+	if err != nil {
+		logrus.Fatal("Faile to load model: ", err)
+	}
+	tk, err := tokenizers.FromFile(path.Join(*modelDir, "tokenizer.json"))
+	if err != nil {
+		logrus.Fatal("Faile to load tokenizer: ", err)
+	}
+	text, err := os.ReadFile(file)
+	if err != nil {
+		logrus.Fatal("Faile to read text: ", err)
+	}
+	tokens, _ := tk.Encode(string(text), false)
+	if *bos {
+		tokens = append([]uint32{llama.Config.BosTokenID}, tokens...)
+	}
+	logrus.Infof("Scoring %d tokens of %s", len(tokens), file)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cfg := model.PerplexityConfig{Window: uint32(*window), Stride: uint32(*stride)}
+	start := time.Now()
+	result, err := llama.Perplexity(ctx, tokens, cfg)
+	if err != nil {
+		logrus.Fatal("Faile to compute perplexity: ", err)
+	}
+
+	summary := PerplexitySummary{
+		Model:       *modelDir,
+		File:        file,
+		Bytes:       len(text),
+		Tokens:      result.Tokens,
+		Window:      result.Window,
+		Stride:      result.Stride,
+		Windows:     result.Windows,
+		NLL:         result.NLL,
+		MeanNLL:     result.MeanNLL,
+		Perplexity:  result.Perplexity,
+		BitsPerByte: result.BitsPerByte(len(text)),
+		Seconds:     time.Since(start).Seconds(),
+	}
+	if *perToken {
+		summary.TokenNLL = result.TokenNLL
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			logrus.Fatal("Faile to create output file: ", err)
+		}
+		defer out.Close()
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(summary); err != nil {
+		logrus.Fatal("Faile to write summary: ", err)
+	}
+}
@@ -0,0 +1,100 @@
+package tensor
+
+import "fmt"
+
+// Backend computes the float32 operators a model is made of. The package
+// functions are the reference implementation, see ReferenceBackend; other
+// backends may replace any operator, for speed or another device, as long
+// as they pass the conformance suite in tensor/backendtest.
+//
+// Operators follow the package functions: the ones returning a tensor
+// allocate it, the others work in place, and shape errors panic except
+// for the attention operators, which return them.
+type Backend interface {
+	// Name identifies the backend in logs.
+	Name() string
+
+	// Gather and MatMulTransB take the weights in any storage format the
+	// backend supports, see Matrix.
+	Gather(table Matrix, indices *Tensor[uint32]) *Tensor[float32]
+	MatMulTransB(a *Tensor[float32], b Matrix) *Tensor[float32]
+	RMSNorm(x, w *Tensor[float32], eps float32) *Tensor[float32]
+	Rope(y *Tensor[float32], startPos uint32, theta float32)
+	MaskedSoftmax(y *Tensor[float32])
+	SwiGLU(y, x *Tensor[float32])
+	Add(x, y *Tensor[float32]) *Tensor[float32]
+	// GroupAttnScore returns the causally masked attention probabilities,
+	// GroupAttnV applies them to the values.
+	GroupAttnScore(q, k *Tensor[float32]) (*Tensor[float32], error)
+	GroupAttnV(attn, v *Tensor[float32]) (*Tensor[float32], error)
+}
+
+// Matrix is a 2-D weight matrix in one of the storage formats: a
+// *Tensor[float32], *Tensor[F16], *Tensor[BF16] or *QTensor.
+type Matrix interface {
+	Shape() []uint32
+	Size() uint32
+}
+
+// ReferenceBackend runs the package-level operators on the CPU.
+type ReferenceBackend struct{}
+
+var _ Backend = ReferenceBackend{}
+
+func (ReferenceBackend) Name() string { return "reference" }
+
+func (ReferenceBackend) Gather(table Matrix, indices *Tensor[uint32]) *Tensor[float32] {
+	switch table := table.(type) {
+	case *Tensor[float32]:
+		return Gather(table, indices)
+	case *Tensor[F16]:
+		return GatherHalf(table, indices)
+	case *Tensor[BF16]:
+		return GatherHalf(table, indices)
+	case *QTensor:
+		return GatherQuant(table, indices)
+	}
+	panic(fmt.Sprintf("Gather: unsupported table type %T", table))
+}
+
+func (ReferenceBackend) MatMulTransB(a *Tensor[float32], b Matrix) *Tensor[float32] {
+	switch b := b.(type) {
+	case *Tensor[float32]:
+		return MatMulTransB(a, b)
+	case *Tensor[F16]:
+		return MatMulTransBHalf(a, b)
+	case *Tensor[BF16]:
+		return MatMulTransBHalf(a, b)
+	case *QTensor:
+		return MatMulTransBQuant(a, b)
+	}
+	panic(fmt.Sprintf("MatMulTransB: unsupported weight type %T", b))
+}
+
+func (ReferenceBackend) RMSNorm(x, w *Tensor[float32], eps float32) *Tensor[float32] {
+	return RMSNorm(x, w, eps)
+}
+
+func (ReferenceBackend) Rope(y *Tensor[float32], startPos uint32, theta float32) {
+	Rope(y, startPos, theta)
+}
+
+func (ReferenceBackend) MaskedSoftmax(y *Tensor[float32]) {
+	MaskedSoftmax(y)
+}
+
+func (ReferenceBackend) SwiGLU(y, x *Tensor[float32]) {
+	SwiGLu(y, x)
+}
+
+func (ReferenceBackend) Add(x, y *Tensor[float32]) *Tensor[float32] {
+	return Add(x, y)
+}
+
+func (ReferenceBackend) GroupAttnScore(q, k *Tensor[float32]) (*Tensor[float32], error) {
+	return GroupAttnScore(q, k)
+}
+
+func (ReferenceBackend) GroupAttnV(attn, v *Tensor[float32]) (*Tensor[float32], error) {
+	return GroupAttnV(attn, v)
+}
@@ -0,0 +1,11 @@
+package tensor_test
+
+import (
+	"learning-lm-go/tensor"
+	"learning-lm-go/tensor/backendtest"
+	"testing"
+)
+
+func TestReferenceBackend(t *testing.T) {
+	backendtest.Run(t, tensor.ReferenceBackend{})
+}
@@ -0,0 +1,315 @@
+// Package backendtest is the conformance suite of tensor.Backend
+// implementations. A backend passes when its operators agree with
+// straightforward float64 implementations within a small relative error,
+// so it is free to reorder or fuse computations.
+package backendtest
+
+import (
+	"learning-lm-go/tensor"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// tolerance is the allowed error relative to max(1, |expected|).
+const tolerance = 1e-4
+
+// Run checks every operator of b.
+func Run(t *testing.T, b tensor.Backend) {
+	t.Run("Gather", func(t *testing.T) { testGather(t, b) })
+	t.Run("MatMulTransB", func(t *testing.T) { testMatMulTransB(t, b) })
+	t.Run("RMSNorm", func(t *testing.T) { testRMSNorm(t, b) })
+	t.Run("Rope", func(t *testing.T) { testRope(t, b) })
+	t.Run("MaskedSoftmax", func(t *testing.T) { testMaskedSoftmax(t, b) })
+	t.Run("SwiGLU", func(t *testing.T) { testSwiGLU(t, b) })
+	t.Run("Add", func(t *testing.T) { testAdd(t, b) })
+	t.Run("GroupAttnScore", func(t *testing.T) { testGroupAttnScore(t, b) })
+	t.Run("GroupAttnV", func(t *testing.T) { testGroupAttnV(t, b) })
+}
+
+func random(rng *rand.Rand, shape ...uint32) *tensor.Tensor[float32] {
+	n := uint32(1)
+	for _, s := range shape {
+		n *= s
+	}
+	data := make([]float32, n)
+	for i := range data {
+		data[i] = rng.Float32()*2 - 1
+	}
+	return tensor.NewTensor(data, shape)
+}
+
+// check compares got with want and its shape with shape.
+func check(t *testing.T, name string, got *tensor.Tensor[float32], want []float64, shape ...uint32) {
+	t.Helper()
+	if len(got.Shape()) != len(shape) {
+		t.Fatalf("%s: shape %v, expected %v", name, got.Shape(), shape)
+	}
+	for i := range shape {
+		if got.Shape()[i] != shape[i] {
+			t.Fatalf("%s: shape %v, expected %v", name, got.Shape(), shape)
+		}
+	}
+	if len(got.Data()) != len(want) {
+		t.Fatalf("%s: %d elements, expected %d", name, len(got.Data()), len(want))
+	}
+	for i, w := range want {
+		if g := float64(got.Data()[i]); math.Abs(g-w) > tolerance*math.Max(1, math.Abs(w)) {
+			t.Fatalf("%s: element %d is %v, expected %v", name, i, g, w)
+		}
+	}
+}
+
+func testGather(t *testing.T, b tensor.Backend) {
+	rng := rand.New(rand.NewSource(1))
+	table := random(rng, 10, 6)
+	indices := []uint32{3, 0, 9, 3}
+	var want []float64
+	for _, idx := range indices {
+		for _, v := range table.Data()[idx*6 : (idx+1)*6] {
+			want = append(want, float64(v))
+		}
+	}
+	check(t, "Gather", b.Gather(table, tensor.NewTensor(indices, []uint32{4})), want, 4, 6)
+
+	// 16-bit and quantized tables hold the rounded values
+	for name, m := range lowPrecision(random(rng, 10, 64)) {
+		exact := b.Gather(toFloat32(m), tensor.NewTensor(indices, []uint32{4}))
+		check(t, "Gather "+name, b.Gather(m, tensor.NewTensor(indices, []uint32{4})), float64s(exact), 4, 64)
+	}
+}
+
+// lowPrecision returns w in every other storage format it fits in: the
+// quantized ones need rows a multiple of tensor.QuantBlockSize long.
+func lowPrecision(w *tensor.Tensor[float32]) map[string]tensor.Matrix {
+	formats := map[string]tensor.Matrix{
+		"F16":  tensor.ToHalf[tensor.F16](w),
+		"BF16": tensor.ToHalf[tensor.BF16](w),
+	}
+	if w.Shape()[1]%tensor.QuantBlockSize != 0 {
+		return formats
+	}
+	for _, typ := range []tensor.QuantType{tensor.Q8_0, tensor.Q4_0} {
+		q, err := tensor.Quantize(w, typ)
+		if err != nil {
+			panic(err)
+		}
+		formats[string(typ)] = q
+	}
+	return formats
+}
+
+// toFloat32 widens a matrix stored in another format.
+func toFloat32(m tensor.Matrix) *tensor.Tensor[float32] {
+	switch m := m.(type) {
+	case *tensor.Tensor[tensor.F16]:
+		return tensor.ToFloat32(m)
+	case *tensor.Tensor[tensor.BF16]:
+		return tensor.ToFloat32(m)
+	case *tensor.QTensor:
+		return m.Dequantize()
+	}
+	panic("not a low-precision matrix")
+}
+
+func float64s(t *tensor.Tensor[float32]) []float64 {
+	out := make([]float64, len(t.Data()))
+	for i, v := range t.Data() {
+		out[i] = float64(v)
+	}
+	return out
+}
+
+func testMatMulTransB(t *testing.T, b tensor.Backend) {
+	rng := rand.New(rand.NewSource(2))
+	for _, dims := range [][3]uint32{{1, 1, 1}, {1, 67, 33}, {5, 9, 130}, {17, 70, 300}, {3, 70, 64}, {17, 9, 320}} {
+		m, n, k := dims[0], dims[1], dims[2]
+		x := random(rng, m, k)
+		w := random(rng, n, k)
+		want := make([]float64, m*n)
+		for i := uint32(0); i < m; i++ {
+			for j := uint32(0); j < n; j++ {
+				for p := uint32(0); p < k; p++ {
+					want[i*n+j] += float64(x.Data()[i*k+p]) * float64(w.Data()[j*k+p])
+				}
+			}
+		}
+		check(t, "MatMulTransB", b.MatMulTransB(x, w), want, m, n)
+		// leading dimensions of a are kept
+		x3 := tensor.NewTensor(x.Data(), []uint32{1, m, k})
+		check(t, "MatMulTransB 3D", b.MatMulTransB(x3, w), want, 1, m, n)
+
+		// low-precision weights give the product with the rounded weights
+		for name, wl := range lowPrecision(w) {
+			rounded := toFloat32(wl)
+			want := make([]float64, m*n)
+			for i := uint32(0); i < m; i++ {
+				for j := uint32(0); j < n; j++ {
+					for p := uint32(0); p < k; p++ {
+						want[i*n+j] += float64(x.Data()[i*k+p]) * float64(rounded.Data()[j*k+p])
+					}
+				}
+			}
+			check(t, "MatMulTransB "+name, b.MatMulTransB(x, wl), want, m, n)
+		}
+	}
+}
+
+func testRMSNorm(t *testing.T, b tensor.Backend) {
+	rng := rand.New(rand.NewSource(3))
+	x := random(rng, 3, 2, 8)
+	w := random(rng, 8)
+	eps := float32(1e-5)
+	var want []float64
+	for row := 0; row < 6; row++ {
+		xs := x.Data()[row*8 : (row+1)*8]
+		sum := 0.0
+		for _, v := range xs {
+			sum += float64(v) * float64(v)
+		}
+		rms := math.Sqrt(sum/8 + float64(eps))
+		for i, v := range xs {
+			want = append(want, float64(w.Data()[i])*float64(v)/rms)
+		}
+	}
+	check(t, "RMSNorm", b.RMSNorm(x, w, eps), want, 3, 2, 8)
+}
+
+func testRope(t *testing.T, b tensor.Backend) {
+	rng := rand.New(rand.NewSource(4))
+	const seqLen, heads, d, start, theta = 3, 2, 8, 5, 10000.0
+	y := random(rng, seqLen, heads, d)
+	want := make([]float64, len(y.Data()))
+	for tok := 0; tok < seqLen; tok++ {
+		for h := 0; h < heads; h++ {
+			base := (tok*heads + h) * d
+			for i := 0; i < d/2; i++ {
+				a, c := float64(y.Data()[base+i]), float64(y.Data()[base+d/2+i])
+				angle := float64(start+tok) / math.Pow(theta, 2*float64(i)/d)
+				sin, cos := math.Sincos(angle)
+				want[base+i] = a*cos - c*sin
+				want[base+d/2+i] = a*sin + c*cos
+			}
+		}
+	}
+	b.Rope(y, start, theta)
+	check(t, "Rope", y, want, seqLen, heads, d)
+}
+
+// softmaxRows is the reference causal softmax over the last two
+// dimensions of data, see tensor.MaskedSoftmax.
+func softmaxRows(data []float64, seqLen, total int) []float64 {
+	out := make([]float64, len(data))
+	for row := 0; row < len(data)/total; row++ {
+		boundary := total - seqLen + row%seqLen + 1
+		xs := data[row*total : row*total+boundary]
+		maxVal := math.Inf(-1)
+		for _, v := range xs {
+			maxVal = math.Max(maxVal, v)
+		}
+		sum := 0.0
+		for _, v := range xs {
+			sum += math.Exp(v - maxVal)
+		}
+		for j, v := range xs {
+			out[row*total+j] = math.Exp(v-maxVal) / sum
+		}
+	}
+	return out
+}
+
+func testMaskedSoftmax(t *testing.T, b tensor.Backend) {
+	rng := rand.New(rand.NewSource(5))
+	y := random(rng, 2, 3, 5)
+	data := make([]float64, len(y.Data()))
+	for i, v := range y.Data() {
+		data[i] = float64(v) * 4
+		y.Data()[i] = v * 4
+	}
+	b.MaskedSoftmax(y)
+	check(t, "MaskedSoftmax", y, softmaxRows(data, 3, 5), 2, 3, 5)
+}
+
+func testSwiGLU(t *testing.T, b tensor.Backend) {
+	rng := rand.New(rand.NewSource(6))
+	y := random(rng, 4, 7)
+	x := random(rng, 4, 7)
+	want := make([]float64, len(y.Data()))
+	for i := range want {
+		xv := float64(x.Data()[i]) * 3
+		x.Data()[i] *= 3
+		want[i] = float64(y.Data()[i]) * xv / (1 + math.Exp(-xv))
+	}
+	b.SwiGLU(y, x)
+	check(t, "SwiGLU", y, want, 4, 7)
+}
+
+func testAdd(t *testing.T, b tensor.Backend) {
+	rng := rand.New(rand.NewSource(7))
+	x := random(rng, 3, 5)
+	y := random(rng, 3, 5)
+	want := make([]float64, 15)
+	for i := range want {
+		want[i] = float64(x.Data()[i]) + float64(y.Data()[i])
+	}
+	check(t, "Add", b.Add(x, y), want, 3, 5)
+}
+
+func testGroupAttnScore(t *testing.T, b tensor.Backend) {
+	rng := rand.New(rand.NewSource(8))
+	const n1, n2, hq, hk, d = 3, 5, 4, 2, 8
+	q := random(rng, n1, hq, d)
+	k := random(rng, n2, hk, d)
+	scores := make([]float64, hq*n1*n2)
+	for h := 0; h < hq; h++ {
+		for i := 0; i < n1; i++ {
+			for j := 0; j < n2; j++ {
+				sum := 0.0
+				for p := 0; p < d; p++ {
+					sum += float64(q.Data()[(i*hq+h)*d+p]) * float64(k.Data()[(j*hk+h/(hq/hk))*d+p])
+				}
+				scores[(h*n1+i)*n2+j] = sum / math.Sqrt(d)
+			}
+		}
+	}
+	got, err := b.GroupAttnScore(q, k)
+	if err != nil {
+		t.Fatalf("GroupAttnScore failed: %v", err)
+	}
+	check(t, "GroupAttnScore", got, softmaxRows(scores, n1, n2), hq, n1, n2)
+
+	if _, err := b.GroupAttnScore(random(rng, n1, 3, d), k); err == nil {
+		t.Errorf("GroupAttnScore should reject 3 query heads for 2 key heads")
+	}
+	if _, err := b.GroupAttnScore(random(rng, n1, hq, d), random(rng, n2, hk, d+2)); err == nil {
+		t.Errorf("GroupAttnScore should reject mismatched head sizes")
+	}
+}
+
+func testGroupAttnV(t *testing.T, b tensor.Backend) {
+	rng := rand.New(rand.NewSource(9))
+	const n1, n2, h, hv, d = 3, 5, 4, 2, 6
+	attn := random(rng, h, n1, n2)
+	v := random(rng, n2, hv, d)
+	want := make([]float64, n1*h*d)
+	for i := 0; i < n1; i++ {
+		for head := 0; head < h; head++ {
+			for p := 0; p < d; p++ {
+				sum := 0.0
+				for j := 0; j < n2; j++ {
+					sum += float64(attn.Data()[(head*n1+i)*n2+j]) * float64(v.Data()[(j*hv+head/(h/hv))*d+p])
+				}
+				want[(i*h+head)*d+p] = sum
+			}
+		}
+	}
+	got, err := b.GroupAttnV(attn, v)
+	if err != nil {
+		t.Fatalf("GroupAttnV failed: %v", err)
+	}
+	check(t, "GroupAttnV", got, want, n1, h, d)
+
+	if _, err := b.GroupAttnV(attn, random(rng, n2+1, hv, d)); err == nil {
+		t.Errorf("GroupAttnV should reject mismatched sequence lengths")
+	}
+}
@@ -0,0 +1,219 @@
+package tensor
+
+import (
+	"fmt"
+	"math"
+)
+
+// F16 is an IEEE 754 half-precision float: 1 sign, 5 exponent and 10
+// mantissa bits.
+type F16 uint16
+
+// BF16 is a bfloat16: the upper half of a float32, with its 8 exponent
+// bits and 7 mantissa bits. It has the range of float32 at a lower
+// precision.
+type BF16 uint16
+
+// HalfDataType is a 16-bit float storage type. Tensors of these types
+// hold weights only; the operators work on float32 and the
+// mixed-precision kernels convert on the fly.
+type HalfDataType interface {
+	F16 | BF16
+	Float32() float32
+}
+
+// ElementType is every type a tensor can store.
+type ElementType interface {
+	TensorDataType | F16 | BF16
+}
+
+// Float32 converts h exactly.
+func (h F16) Float32() float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h) & 0x3ff
+	switch {
+	case exp == 0x1f:
+		// infinity or NaN, keeping the payload
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	case exp != 0:
+		return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+	case mant == 0:
+		return math.Float32frombits(sign)
+	}
+	// subnormal: normalise the mantissa
+	exp = 127 - 15 + 1
+	for mant&0x400 == 0 {
+		mant <<= 1
+		exp--
+	}
+	return math.Float32frombits(sign | exp<<23 | (mant&0x3ff)<<13)
+}
+
+func (h F16) String() string {
+	return fmt.Sprint(h.Float32())
+}
+
+// F16FromFloat32 rounds f to the nearest F16, ties to even. Values beyond
+// the F16 range become infinities.
+func F16FromFloat32(f float32) F16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int32(bits>>23) & 0xff
+	mant := bits & 0x7fffff
+	if exp == 0xff {
+		if mant != 0 {
+			// keep NaN a NaN, even when the payload is in the low bits
+			return F16(sign | 0x7e00 | uint16(mant>>13))
+		}
+		return F16(sign | 0x7c00)
+	}
+
+	exp -= 127 - 15
+	if exp >= 0x1f {
+		return F16(sign | 0x7c00)
+	}
+	if exp <= 0 {
+		// subnormal or zero: shift the implicit bit in and round
+		if exp < -10 {
+			return F16(sign)
+		}
+		mant |= 0x800000
+		shift := uint32(14 - exp)
+		half := uint32(1) << (shift - 1)
+		rest := mant & (1<<shift - 1)
+		m := mant >> shift
+		if rest > half || (rest == half && m&1 == 1) {
+			m++
+		}
+		return F16(sign | uint16(m))
+	}
+	m := uint16(mant >> 13)
+	h := sign | uint16(exp)<<10 | m
+	rest := mant & 0x1fff
+	if rest > 0x1000 || (rest == 0x1000 && m&1 == 1) {
+		// a carry out of the mantissa correctly bumps the exponent
+		h++
+	}
+	return F16(h)
+}
+
+// Float32 converts h exactly.
+func (h BF16) Float32() float32 {
+	return math.Float32frombits(uint32(h) << 16)
+}
+
+func (h BF16) String() string {
+	return fmt.Sprint(h.Float32())
+}
+
+// BF16FromFloat32 rounds f to the nearest BF16, ties to even.
+func BF16FromFloat32(f float32) BF16 {
+	bits := math.Float32bits(f)
+	if bits&0x7fffffff > 0x7f800000 {
+		// NaN: truncating could clear the payload and make it infinite
+		return BF16(bits>>16 | 0x40)
+	}
+	bits += 0x7fff + (bits>>16)&1
+	return BF16(bits >> 16)
+}
+
+func fromFloat32[H HalfDataType](f float32) H {
+	var h H
+	switch p := any(&h).(type) {
+	case *F16:
+		*p = F16FromFloat32(f)
+	case *BF16:
+		*p = BF16FromFloat32(f)
+	}
+	return h
+}
+
+// ToHalf converts t to 16-bit storage, rounding to nearest.
+func ToHalf[H HalfDataType](t *Tensor[float32]) *Tensor[H] {
+	data := make([]H, len(t.Data()))
+	for i, v := range t.Data() {
+		data[i] = fromFloat32[H](v)
+	}
+	return NewTensor(data, append([]uint32(nil), t.Shape()...))
+}
+
+// ToFloat32 converts a 16-bit tensor back to float32.
+func ToFloat32[H HalfDataType](t *Tensor[H]) *Tensor[float32] {
+	data := make([]float32, len(t.Data()))
+	halfToFloat32(data, t.Data())
+	return NewTensor(data, append([]uint32(nil), t.Shape()...))
+}
+
+func halfToFloat32[H HalfDataType](dst []float32, src []H) {
+	for i, v := range src[:len(dst)] {
+		dst[i] = v.Float32()
+	}
+}
+
+// GatherHalf is Gather over a 16-bit table, returning float32 rows.
+func GatherHalf[H HalfDataType](table *Tensor[H], indices *Tensor[uint32]) *Tensor[float32] {
+	if len(table.shape) != 2 {
+		panic("input must be a 2D tensor")
+	}
+	if len(indices.shape) != 1 {
+		panic("indices must be a 1D tensor")
+	}
+	d := table.shape[1]
+	output := EmptyTensor[float32]([]uint32{uint32(len(indices.Data())), d})
+	for i, idx := range indices.Data() {
+		halfToFloat32(output.Data()[uint32(i)*d:(uint32(i)+1)*d], table.Data()[idx*d:(idx+1)*d])
+	}
+	return output
+}
+
+// MatMulTransBHalf computes a @ b^T for 16-bit weights b, accumulating in
+// float32. Each block of blockN rows of b is converted once into a
+// float32 scratch buffer and then runs through the MatMulTransB kernel, so
+// the result is bit for bit MatMulTransB(a, ToFloat32(b)) while only the
+// 16-bit weights stay in memory.
+func MatMulTransBHalf[H HalfDataType](a *Tensor[float32], b *Tensor[H]) *Tensor[float32] {
+	if len(b.Shape()) != 2 {
+		panic("MatMul: b must have exactly 2 dimensions")
+	}
+	nk := b.shape[1]
+	return matMulTransBConvert(a, b.shape, func(dst []float32, j0, j1 uint32) {
+		halfToFloat32(dst, b.data[j0*nk:j1*nk])
+	})
+}
+
+// matMulTransBConvert computes a @ b^T where b, of the given shape, is
+// stored in another format: convert writes rows [j0, j1) of b into dst as
+// float32.
+func matMulTransBConvert(a *Tensor[float32], bShape []uint32, convert func(dst []float32, j0, j1 uint32)) *Tensor[float32] {
+	if len(a.Shape()) < 2 {
+		panic("MatMul: a must have at least 2 dimensions")
+	}
+	ndimA := len(a.Shape())
+	nk := a.shape[ndimA-1]
+	if nk != bShape[1] {
+		panic(fmt.Sprintf("MatMul: a and b must have the same size in the last dimension, got %d and %d", nk, bShape[1]))
+	}
+	na := a.Size() / nk
+	nb := bShape[0]
+
+	data := make([]float32, na*nb)
+	ad := a.Data()
+	blocks := uint64((nb + blockN - 1) / blockN)
+	parallelFor(blocks, uint64(na)*uint64(nb)*uint64(nk), func(lo, hi uint64) {
+		scratch := make([]float32, blockN*nk)
+		for block := lo; block < hi; block++ {
+			j0 := uint32(block) * blockN
+			j1 := min(j0+blockN, nb)
+			convert(scratch[:(j1-j0)*nk], j0, j1)
+			for i0 := uint32(0); i0 < na; i0 += blockM {
+				matMulTransBTile(data, ad, scratch, nb, nk, i0, min(i0+blockM, na), j0, j1)
+			}
+		}
+	})
+
+	shape := make([]uint32, 0, ndimA)
+	shape = append(shape, a.shape[:ndimA-1]...)
+	shape = append(shape, nb)
+	return NewTensor(data, shape)
+}
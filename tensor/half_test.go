@@ -0,0 +1,121 @@
+package tensor
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestF16Conversion(t *testing.T) {
+	cases := []struct {
+		f float32
+		h F16
+	}{
+		{0, 0x0000},
+		{float32(math.Copysign(0, -1)), 0x8000},
+		{1, 0x3c00},
+		{-2, 0xc000},
+		{0.1, 0x2e66},
+		{65504, 0x7bff},                           // largest finite
+		{65520, 0x7c00},                           // rounds up to infinity
+		{float32(math.Ldexp(1, -24)), 0x0001},     // smallest subnormal
+		{float32(math.Ldexp(1, -25)), 0x0000},     // tie, rounds to even
+		{float32(math.Ldexp(1.5, -25)), 0x0001},   // above the tie
+		{float32(math.Ldexp(1, -14)), 0x0400},     // smallest normal
+		{1 + float32(math.Ldexp(1, -11)), 0x3c00}, // tie, rounds to even
+		{1 + float32(math.Ldexp(3, -11)), 0x3c02}, // tie, rounds to even
+		{float32(math.Inf(1)), 0x7c00},
+		{float32(math.Inf(-1)), 0xfc00},
+	}
+	for _, c := range cases {
+		if got := F16FromFloat32(c.f); got != c.h {
+			t.Errorf("F16FromFloat32(%v) = %#04x, expected %#04x", c.f, uint16(got), uint16(c.h))
+		}
+	}
+	if f := F16FromFloat32(float32(math.NaN())).Float32(); !math.IsNaN(float64(f)) {
+		t.Errorf("NaN converted to %v", f)
+	}
+
+	// every finite value and infinity survives the round trip
+	for bits := 0; bits < 1<<16; bits++ {
+		h := F16(bits)
+		f := h.Float32()
+		if math.IsNaN(float64(f)) {
+			if h&0x7c00 != 0x7c00 || h&0x3ff == 0 {
+				t.Fatalf("%#04x decoded to NaN", bits)
+			}
+			continue
+		}
+		if back := F16FromFloat32(f); back != h {
+			t.Fatalf("%#04x -> %v -> %#04x", bits, f, uint16(back))
+		}
+	}
+}
+
+func TestBF16Conversion(t *testing.T) {
+	cases := []struct {
+		f float32
+		h BF16
+	}{
+		{0, 0x0000},
+		{1, 0x3f80},
+		{-2, 0xc000},
+		{0.1, 0x3dcd},
+		{math.Float32frombits(0x3f808000), 0x3f80}, // tie, rounds to even
+		{math.Float32frombits(0x3f818000), 0x3f82}, // tie, rounds to even
+		{math.Float32frombits(0x3f808001), 0x3f81},
+		{math.MaxFloat32, 0x7f80}, // rounds up to infinity
+		{float32(math.Inf(-1)), 0xff80},
+	}
+	for _, c := range cases {
+		if got := BF16FromFloat32(c.f); got != c.h {
+			t.Errorf("BF16FromFloat32(%v) = %#04x, expected %#04x", c.f, uint16(got), uint16(c.h))
+		}
+	}
+	// a NaN whose payload is only in the low bits stays a NaN
+	if f := BF16FromFloat32(math.Float32frombits(0x7f800001)).Float32(); !math.IsNaN(float64(f)) {
+		t.Errorf("NaN converted to %v", f)
+	}
+	for bits := 0; bits < 1<<16; bits++ {
+		h := BF16(bits)
+		if f := h.Float32(); !math.IsNaN(float64(f)) && BF16FromFloat32(f) != h {
+			t.Fatalf("%#04x does not survive the round trip", bits)
+		}
+	}
+}
+
+func TestMatMulTransBHalf(t *testing.T) {
+	defer SetMatMulWorkers(0)
+	SetMatMulWorkers(3)
+	rng := rand.New(rand.NewSource(3))
+	for _, dims := range [][3]uint32{{1, 2048, 128}, {7, 130, 65}, {20, 64, 300}} {
+		a := randomTensor(rng, []uint32{dims[0], dims[2]})
+		b := randomTensor(rng, []uint32{dims[1], dims[2]})
+
+		f16 := ToHalf[F16](b)
+		if !reflect.DeepEqual(MatMulTransBHalf(a, f16).Data(), MatMulTransB(a, ToFloat32(f16)).Data()) {
+			t.Errorf("%v: F16 product differs from the product with converted weights", dims)
+		}
+		bf16 := ToHalf[BF16](b)
+		y := MatMulTransBHalf(a, bf16)
+		if !reflect.DeepEqual(y.Data(), MatMulTransB(a, ToFloat32(bf16)).Data()) {
+			t.Errorf("%v: BF16 product differs from the product with converted weights", dims)
+		}
+		// bfloat16 keeps about 3 significant digits, the rounding errors of
+		// the k products add up like a random walk
+		exact := MatMulTransB(a, b)
+		bound := 0.01 * math.Sqrt(float64(dims[2]))
+		for i, v := range y.Data() {
+			if math.Abs(float64(v-exact.Data()[i])) > bound {
+				t.Fatalf("%v: BF16 product %v is far from the float32 %v", dims, v, exact.Data()[i])
+			}
+		}
+	}
+
+	table := NewTensor([]float32{1, 2, 3, 4, 5, 6}, []uint32{3, 2})
+	rows := GatherHalf(ToHalf[BF16](table), NewTensor([]uint32{2, 0}, []uint32{2}))
+	if !reflect.DeepEqual(rows.Data(), []float32{5, 6, 1, 2}) {
+		t.Errorf("GatherHalf returned %v", rows.Data())
+	}
+}
@@ -0,0 +1,163 @@
+package tensor
+
+// Block sizes of the MatMulTransB kernel. The output is cut into tiles of
+// blockM x blockN elements, the unit of work handed to the workers; a
+// tile's blockN rows of b are walked blockK columns at a time so that they
+// stay in cache while the rows of a stream past them. Inside a tile 4x4
+// outputs are accumulated in registers, so every element loaded from a or
+// b feeds four multiply-adds instead of one.
+const (
+	blockM = 16
+	blockN = 64
+	blockK = 256
+)
+
+// matMulTransBTiles computes the tiles [lo, hi) of data = a @ b^T, where a
+// is (na, nk), b is (nb, nk) and data is (na, nb) and zeroed. Tiles are
+// numbered down the columns of tiles first, so consecutive tiles reuse the
+// same rows of b.
+func matMulTransBTiles[T TensorDataType](data, ad, bd []T, na, nb, nk uint32, lo, hi uint64) {
+	mTiles := uint64((na + blockM - 1) / blockM)
+	for tile := lo; tile < hi; tile++ {
+		i0 := uint32(tile%mTiles) * blockM
+		j0 := uint32(tile/mTiles) * blockN
+		matMulTransBTile(data, ad, bd[j0*nk:], nb, nk, i0, min(i0+blockM, na), j0, min(j0+blockN, nb))
+	}
+}
+
+// matMulTransBTile computes the outputs in rows [i0, i1) and columns
+// [j0, j1) of data; bd starts at row j0 of b.
+//
+// Every output is still summed over k in increasing order with a single
+// accumulator, so the result is bit for bit that of the naive loop.
+func matMulTransBTile[T TensorDataType](data, ad, bd []T, nb, nk, i0, i1, j0, j1 uint32) {
+	for k0 := uint32(0); k0 < nk; k0 += blockK {
+		k1 := min(k0+blockK, nk)
+		i := i0
+		for ; i+4 <= i1; i += 4 {
+			j := j0
+			for ; j+4 <= j1; j += 4 {
+				kernel4x4(data, ad, bd, nb, nk, i, j, j-j0, k0, k1)
+			}
+			for ; j < j1; j++ {
+				for r := i; r < i+4; r++ {
+					kernel1x1(data, ad, bd, nb, nk, r, j, j-j0, k0, k1)
+				}
+			}
+		}
+		for ; i < i1; i++ {
+			j := j0
+			for ; j+4 <= j1; j += 4 {
+				kernel1x4(data, ad, bd, nb, nk, i, j, j-j0, k0, k1)
+			}
+			for ; j < j1; j++ {
+				kernel1x1(data, ad, bd, nb, nk, i, j, j-j0, k0, k1)
+			}
+		}
+	}
+}
+
+// kernel4x4 adds the products over [k0, k1) to the outputs of rows i..i+3
+// and columns j..j+3, which are rows jb..jb+3 of bd.
+func kernel4x4[T TensorDataType](data, ad, bd []T, nb, nk, i, j, jb, k0, k1 uint32) {
+	n := k1 - k0
+	a0 := ad[i*nk+k0:][:n]
+	a1 := ad[(i+1)*nk+k0:][:n]
+	a2 := ad[(i+2)*nk+k0:][:n]
+	a3 := ad[(i+3)*nk+k0:][:n]
+	b0 := bd[jb*nk+k0:][:n]
+	b1 := bd[(jb+1)*nk+k0:][:n]
+	b2 := bd[(jb+2)*nk+k0:][:n]
+	b3 := bd[(jb+3)*nk+k0:][:n]
+	o0 := data[i*nb+j:][:4]
+	o1 := data[(i+1)*nb+j:][:4]
+	o2 := data[(i+2)*nb+j:][:4]
+	o3 := data[(i+3)*nb+j:][:4]
+
+	s00, s01, s02, s03 := o0[0], o0[1], o0[2], o0[3]
+	s10, s11, s12, s13 := o1[0], o1[1], o1[2], o1[3]
+	s20, s21, s22, s23 := o2[0], o2[1], o2[2], o2[3]
+	s30, s31, s32, s33 := o3[0], o3[1], o3[2], o3[3]
+	for k := range a0 {
+		x0, x1, x2, x3 := a0[k], a1[k], a2[k], a3[k]
+		y0, y1, y2, y3 := b0[k], b1[k], b2[k], b3[k]
+		s00 += x0 * y0
+		s01 += x0 * y1
+		s02 += x0 * y2
+		s03 += x0 * y3
+		s10 += x1 * y0
+		s11 += x1 * y1
+		s12 += x1 * y2
+		s13 += x1 * y3
+		s20 += x2 * y0
+		s21 += x2 * y1
+		s22 += x2 * y2
+		s23 += x2 * y3
+		s30 += x3 * y0
+		s31 += x3 * y1
+		s32 += x3 * y2
+		s33 += x3 * y3
+	}
+	o0[0], o0[1], o0[2], o0[3] = s00, s01, s02, s03
+	o1[0], o1[1], o1[2], o1[3] = s10, s11, s12, s13
+	o2[0], o2[1], o2[2], o2[3] = s20, s21, s22, s23
+	o3[0], o3[1], o3[2], o3[3] = s30, s31, s32, s33
+}
+
+// kernel1x4 is kernel4x4 for a single row of a, the shape of a decode
+// step. The loop over k is unrolled by four.
+func kernel1x4[T TensorDataType](data, ad, bd []T, nb, nk, i, j, jb, k0, k1 uint32) {
+	n := k1 - k0
+	a0 := ad[i*nk+k0:][:n]
+	b0 := bd[jb*nk+k0:][:n]
+	b1 := bd[(jb+1)*nk+k0:][:n]
+	b2 := bd[(jb+2)*nk+k0:][:n]
+	b3 := bd[(jb+3)*nk+k0:][:n]
+	o := data[i*nb+j:][:4]
+
+	s0, s1, s2, s3 := o[0], o[1], o[2], o[3]
+	k := 0
+	for ; k+4 <= len(a0); k += 4 {
+		x := a0[k : k+4 : k+4]
+		y0 := b0[k : k+4 : k+4]
+		y1 := b1[k : k+4 : k+4]
+		y2 := b2[k : k+4 : k+4]
+		y3 := b3[k : k+4 : k+4]
+		s0 += x[0] * y0[0]
+		s0 += x[1] * y0[1]
+		s0 += x[2] * y0[2]
+		s0 += x[3] * y0[3]
+		s1 += x[0] * y1[0]
+		s1 += x[1] * y1[1]
+		s1 += x[2] * y1[2]
+		s1 += x[3] * y1[3]
+		s2 += x[0] * y2[0]
+		s2 += x[1] * y2[1]
+		s2 += x[2] * y2[2]
+		s2 += x[3] * y2[3]
+		s3 += x[0] * y3[0]
+		s3 += x[1] * y3[1]
+		s3 += x[2] * y3[2]
+		s3 += x[3] * y3[3]
+	}
+	for ; k < len(a0); k++ {
+		x := a0[k]
+		s0 += x * b0[k]
+		s1 += x * b1[k]
+		s2 += x * b2[k]
+		s3 += x * b3[k]
+	}
+	o[0], o[1], o[2], o[3] = s0, s1, s2, s3
+}
+
+// kernel1x1 handles the outputs left over at the edges of a tile.
+func kernel1x1[T TensorDataType](data, ad, bd []T, nb, nk, i, j, jb, k0, k1 uint32) {
+	n := k1 - k0
+	a0 := ad[i*nk+k0:][:n]
+	b0 := bd[jb*nk+k0:][:n]
+	sum := data[i*nb+j]
+	for k := range a0 {
+		sum += a0[k] * b0[k]
+	}
+	data[i*nb+j] = sum
+}
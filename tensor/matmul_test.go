@@ -0,0 +1,77 @@
+package tensor
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// naiveMatMulTransB is the reference triple loop.
+func naiveMatMulTransB[T TensorDataType](a, b *Tensor[T]) *Tensor[T] {
+	nk := a.shape[len(a.shape)-1]
+	na, nb := a.Size()/nk, b.shape[0]
+	data := make([]T, na*nb)
+	for i := uint32(0); i < na; i++ {
+		for j := uint32(0); j < nb; j++ {
+			sum := T(0)
+			for k := uint32(0); k < nk; k++ {
+				sum += a.data[i*nk+k] * b.data[j*nk+k]
+			}
+			data[i*nb+j] = sum
+		}
+	}
+	return NewTensor(data, []uint32{na, nb})
+}
+
+func TestMatMulTransBBlocked(t *testing.T) {
+	defer SetMatMulWorkers(0)
+	SetMatMulWorkers(3)
+	rng := rand.New(rand.NewSource(2))
+	// shapes around the tile, micro-kernel and unrolling sizes, and ones
+	// spanning several k blocks
+	for _, dims := range [][3]uint32{
+		{1, 1, 1}, {1, 5, 3}, {3, 4, 7}, {4, 4, 4}, {5, 9, 13}, {16, 64, 256},
+		{17, 65, 257}, {1, 2048, 128}, {31, 3, 600}, {64, 384, 128},
+	} {
+		a := randomTensor(rng, []uint32{dims[0], dims[2]})
+		b := randomTensor(rng, []uint32{dims[1], dims[2]})
+		if !reflect.DeepEqual(MatMulTransB(a, b).Data(), naiveMatMulTransB(a, b).Data()) {
+			t.Errorf("%v differs from the naive kernel", dims)
+		}
+	}
+
+	// other element types and a batched a
+	ai := NewTensor([]int64{1, -2, 3, 4, 5, -6, 7, 8, 9, 10, 11, -12}, []uint32{2, 1, 6})
+	bi := NewTensor([]int64{1, 2, 3, 4, 5, 6, -1, 0, 1, 0, -1, 0}, []uint32{2, 6})
+	yi := MatMulTransB(ai, bi)
+	if !reflect.DeepEqual(yi.Shape(), []uint32{2, 1, 2}) || !reflect.DeepEqual(yi.Data(), naiveMatMulTransB(ai, bi).Data()) {
+		t.Errorf("int64 MatMulTransB failed: %v", yi.Data())
+	}
+	a64 := NewTensor([]float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1.0}, []uint32{5, 2})
+	b64 := NewTensor([]float64{1, 2, 3, 4, 5, 6}, []uint32{3, 2})
+	if !reflect.DeepEqual(MatMulTransB(a64, b64).Data(), naiveMatMulTransB(a64, b64).Data()) {
+		t.Errorf("float64 MatMulTransB differs from the naive kernel")
+	}
+}
+
+func BenchmarkMatMulTransBKernel(b *testing.B) {
+	defer SetMatMulWorkers(0)
+	SetMatMulWorkers(1)
+	rng := rand.New(rand.NewSource(1))
+	for _, dims := range [][3]uint32{{1, 2048, 128}, {64, 384, 128}, {256, 256, 256}} {
+		x := randomTensor(rng, []uint32{dims[0], dims[2]})
+		w := randomTensor(rng, []uint32{dims[1], dims[2]})
+		name := fmt.Sprintf("%dx%dx%d", dims[0], dims[1], dims[2])
+		b.Run(name+"/naive", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				naiveMatMulTransB(x, w)
+			}
+		})
+		b.Run(name+"/blocked", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				MatMulTransB(x, w)
+			}
+		})
+	}
+}
@@ -210,7 +210,8 @@ func ScalarMul[T TensorDataType](a T, x *Tensor[T]) {
 	}
 }
 
-// Calculate A @ B^T
+// Calculate A @ B^T with a cache-blocked kernel, the output split between
+// MatMulWorkers goroutines
 func MatMulTransB[T TensorDataType](a *Tensor[T], b *Tensor[T]) *Tensor[T] {
 	if len(a.Shape()) < 2 {
 		panic("MatMul: a must have at least 2 dimensions")
@@ -227,20 +228,18 @@ func MatMulTransB[T TensorDataType](a *Tensor[T], b *Tensor[T]) *Tensor[T] {
 
 	na := a.Size() / a.shape[ndimA-1]
 	nb := b.Size() / b.shape[1]
+	nk := a.shape[ndimA-1]
 
 	data := make([]T, na*nb)
-
-	for i := uint32(0); i < na; i++ {
-		for j := uint32(0); j < nb; j++ {
-			sum := T(0)
-			baseA := i * a.shape[ndimA-1]
-			baseB := j * b.shape[1]
-			for k := uint32(0); k < a.shape[ndimA-1]; k++ {
-				sum += a.Data()[baseA+k] * b.Data()[baseB+k]
-			}
-			data[i*nb+j] = sum
-		}
-	}
+	ad, bd := a.Data(), b.Data()
+
+	// the tiles of the output are split between the workers; with a single
+	// row (decoding) there still is one per blockN columns
+	tiles := uint64((na+blockM-1)/blockM) * uint64((nb+blockN-1)/blockN)
+	work := uint64(na) * uint64(nb) * uint64(nk)
+	parallelFor(tiles, work, func(lo, hi uint64) {
+		matMulTransBTiles(data, ad, bd, na, nb, nk, lo, hi)
+	})
 
 	shape := make([]uint32, 0, ndimA)
 	shape = append(shape, a.shape[:ndimA-1]...)
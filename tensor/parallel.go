@@ -0,0 +1,59 @@
+package tensor
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// matMulWorkers is the number of goroutines MatMulTransB splits its output
+// between; 0 means runtime.GOMAXPROCS(0).
+var matMulWorkers atomic.Int64
+
+// minParallelWork is the number of multiply-adds below which MatMulTransB
+// stays on the calling goroutine, where starting workers costs more than
+// it saves.
+const minParallelWork = 1 << 15
+
+// SetMatMulWorkers sets the number of goroutines MatMulTransB uses. n <= 0
+// restores the default, runtime.GOMAXPROCS(0). The results do not depend
+// on it: every output element is summed in the same order by one worker.
+func SetMatMulWorkers(n int) {
+	if n < 0 {
+		n = 0
+	}
+	matMulWorkers.Store(int64(n))
+}
+
+// MatMulWorkers returns the number of goroutines MatMulTransB uses.
+func MatMulWorkers() int {
+	if n := matMulWorkers.Load(); n > 0 {
+		return int(n)
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// parallelFor splits [0, n) into contiguous ranges and calls fn on each
+// from its own goroutine, using at most MatMulWorkers of them and only as
+// many as work, the total cost in multiply-adds, justifies. It returns
+// once every range is done.
+func parallelFor(n, work uint64, fn func(lo, hi uint64)) {
+	workers := uint64(MatMulWorkers())
+	workers = min(workers, n, max(work/minParallelWork, 1))
+	if workers <= 1 {
+		fn(0, n)
+		return
+	}
+
+	var wg sync.WaitGroup
+	chunk := (n + workers - 1) / workers
+	for lo := uint64(0); lo < n; lo += chunk {
+		hi := min(lo+chunk, n)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(lo, hi)
+		}()
+	}
+	wg.Wait()
+}
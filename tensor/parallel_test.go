@@ -0,0 +1,59 @@
+package tensor
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func randomTensor(rng *rand.Rand, shape []uint32) *Tensor[float32] {
+	data := make([]float32, calculateSize(shape))
+	for i := range data {
+		data[i] = rng.Float32()*2 - 1
+	}
+	return NewTensor(data, shape)
+}
+
+func TestMatMulTransBWorkers(t *testing.T) {
+	defer SetMatMulWorkers(0)
+	rng := rand.New(rand.NewSource(1))
+	for _, dims := range [][3]uint32{{1, 2048, 128}, {7, 384, 128}, {33, 129, 65}, {2, 3, 4}} {
+		a := randomTensor(rng, []uint32{dims[0], dims[2]})
+		b := randomTensor(rng, []uint32{dims[1], dims[2]})
+		expected := naiveMatMulTransB(a, b)
+		for _, workers := range []int{1, 2, 3, 8, 64} {
+			SetMatMulWorkers(workers)
+			y := MatMulTransB(a, b)
+			// the sums run in the same order, so the results are identical
+			if !reflect.DeepEqual(y.Data(), expected.Data()) {
+				t.Errorf("%v with %d workers differs from the reference", dims, workers)
+			}
+		}
+	}
+
+	SetMatMulWorkers(0)
+	if MatMulWorkers() != runtime.GOMAXPROCS(0) {
+		t.Errorf("Expected GOMAXPROCS workers by default, got %d", MatMulWorkers())
+	}
+}
+
+func BenchmarkMatMulTransB(b *testing.B) {
+	defer SetMatMulWorkers(0)
+	rng := rand.New(rand.NewSource(1))
+	// a decode step through the LM head and a prefill through the FFN of
+	// the story model
+	for _, dims := range [][3]uint32{{1, 2048, 128}, {64, 384, 128}} {
+		x := randomTensor(rng, []uint32{dims[0], dims[2]})
+		w := randomTensor(rng, []uint32{dims[1], dims[2]})
+		for workers := 1; workers <= max(runtime.GOMAXPROCS(0), 4); workers *= 2 {
+			b.Run(fmt.Sprintf("%dx%dx%d/workers=%d", dims[0], dims[1], dims[2], workers), func(b *testing.B) {
+				SetMatMulWorkers(workers)
+				for i := 0; i < b.N; i++ {
+					MatMulTransB(x, w)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package tensor
+
+import (
+	"fmt"
+	"math"
+)
+
+// QuantType is a block quantization format.
+type QuantType string
+
+const (
+	// Q8_0 stores every block as an F16 scale and 32 int8 values, 8.5 bits
+	// per weight.
+	Q8_0 QuantType = "Q8_0"
+	// Q4_0 stores every block as an F16 scale and 32 4-bit values, 4.5
+	// bits per weight.
+	Q4_0 QuantType = "Q4_0"
+)
+
+// QuantBlockSize is the number of consecutive elements of a row sharing
+// one scale.
+const QuantBlockSize = 32
+
+// QTensor is a 2-D matrix quantized by blocks of QuantBlockSize elements
+// along its rows. An element is its block's scale times a small integer.
+type QTensor struct {
+	typ    QuantType
+	shape  []uint32
+	scales []F16  // one per block, row by row
+	quants []byte // Q8_0: an int8 per element; Q4_0: two elements per byte
+}
+
+// Quantize quantizes a 2-D matrix whose rows are a multiple of
+// QuantBlockSize long.
+func Quantize(t *Tensor[float32], typ QuantType) (*QTensor, error) {
+	if len(t.shape) != 2 {
+		return nil, fmt.Errorf("quantize: expected a 2D tensor, got shape %v", t.shape)
+	}
+	if t.shape[1]%QuantBlockSize != 0 {
+		return nil, fmt.Errorf("quantize: row length %d is not a multiple of %d", t.shape[1], QuantBlockSize)
+	}
+	nBlocks := t.Size() / QuantBlockSize
+	q := &QTensor{
+		typ:    typ,
+		shape:  append([]uint32(nil), t.shape...),
+		scales: make([]F16, nBlocks),
+	}
+	switch typ {
+	case Q8_0:
+		q.quants = make([]byte, t.Size())
+	case Q4_0:
+		q.quants = make([]byte, t.Size()/2)
+	default:
+		return nil, fmt.Errorf("quantize: unknown type %q", typ)
+	}
+
+	for block := uint32(0); block < nBlocks; block++ {
+		xs := t.data[block*QuantBlockSize : (block+1)*QuantBlockSize]
+		if typ == Q8_0 {
+			q.scales[block] = quantizeQ8(xs, q.quants[block*QuantBlockSize:(block+1)*QuantBlockSize])
+		} else {
+			q.scales[block] = quantizeQ4(xs, q.quants[block*QuantBlockSize/2:(block+1)*QuantBlockSize/2])
+		}
+	}
+	return q, nil
+}
+
+// quantizeQ8 maps the largest magnitude of xs to ±127.
+func quantizeQ8(xs []float32, out []byte) F16 {
+	amax := float32(0)
+	for _, x := range xs {
+		amax = max(amax, float32(math.Abs(float64(x))))
+	}
+	scale := F16FromFloat32(amax / 127)
+	d := scale.Float32()
+	for i, x := range xs {
+		v := float32(0)
+		if d != 0 {
+			v = float32(math.Round(float64(x / d)))
+		}
+		out[i] = byte(int8(max(-127, min(127, v))))
+	}
+	return scale
+}
+
+// quantizeQ4 maps the element of largest magnitude to -8, so the range
+// [-8, 7] is used in full on the side that matters. Element i of the block
+// is in the low nibble of out[i] for the first half and in the high nibble
+// of out[i-16] for the second.
+func quantizeQ4(xs []float32, out []byte) F16 {
+	extreme := float32(0)
+	for _, x := range xs {
+		if math.Abs(float64(x)) > math.Abs(float64(extreme)) {
+			extreme = x
+		}
+	}
+	scale := F16FromFloat32(extreme / -8)
+	d := scale.Float32()
+	nibble := func(x float32) byte {
+		if d == 0 {
+			return 8
+		}
+		return byte(max(0, min(15, math.Round(float64(x/d))+8)))
+	}
+	half := len(xs) / 2
+	for i := range out {
+		out[i] = nibble(xs[i]) | nibble(xs[half+i])<<4
+	}
+	return scale
+}
+
+// Type returns the quantization format.
+func (q *QTensor) Type() QuantType {
+	return q.typ
+}
+
+// Shape returns the shape of the matrix.
+func (q *QTensor) Shape() []uint32 {
+	return q.shape
+}
+
+// Size returns the number of elements.
+func (q *QTensor) Size() uint32 {
+	return q.shape[0] * q.shape[1]
+}
+
+// Bytes returns the memory taken by the scales and the quantized values.
+func (q *QTensor) Bytes() uint64 {
+	return uint64(len(q.scales))*2 + uint64(len(q.quants))
+}
+
+// dequantizeRows writes rows [j0, j1) into dst as float32.
+func (q *QTensor) dequantizeRows(dst []float32, j0, j1 uint32) {
+	first := j0 * q.shape[1] / QuantBlockSize
+	last := j1 * q.shape[1] / QuantBlockSize
+	for block := first; block < last; block++ {
+		d := q.scales[block].Float32()
+		out := dst[(block-first)*QuantBlockSize : (block-first+1)*QuantBlockSize]
+		if q.typ == Q8_0 {
+			for i, v := range q.quants[block*QuantBlockSize : (block+1)*QuantBlockSize] {
+				out[i] = float32(int8(v)) * d
+			}
+			continue
+		}
+		half := QuantBlockSize / 2
+		for i, v := range q.quants[block*QuantBlockSize/2 : (block+1)*QuantBlockSize/2] {
+			out[i] = float32(int(v&0x0f)-8) * d
+			out[half+i] = float32(int(v>>4)-8) * d
+		}
+	}
+}
+
+// Dequantize converts q back to a float32 matrix.
+func (q *QTensor) Dequantize() *Tensor[float32] {
+	t := EmptyTensor[float32](append([]uint32(nil), q.shape...))
+	q.dequantizeRows(t.data, 0, q.shape[0])
+	return t
+}
+
+// GatherQuant is Gather over a quantized table, returning float32 rows.
+func GatherQuant(table *QTensor, indices *Tensor[uint32]) *Tensor[float32] {
+	if len(indices.shape) != 1 {
+		panic("indices must be a 1D tensor")
+	}
+	d := table.shape[1]
+	output := EmptyTensor[float32]([]uint32{uint32(len(indices.Data())), d})
+	for i, idx := range indices.Data() {
+		if idx >= table.shape[0] {
+			panic(fmt.Sprintf("index %d out of range", idx))
+		}
+		table.dequantizeRows(output.Data()[uint32(i)*d:(uint32(i)+1)*d], idx, idx+1)
+	}
+	return output
+}
+
+// MatMulTransBQuant computes a @ b^T for quantized weights b, accumulating
+// in float32. Like MatMulTransBHalf it dequantizes one block of rows of b
+// at a time into a scratch buffer that stays in cache, so the result is
+// bit for bit MatMulTransB(a, b.Dequantize()).
+func MatMulTransBQuant(a *Tensor[float32], b *QTensor) *Tensor[float32] {
+	return matMulTransBConvert(a, b.shape, b.dequantizeRows)
+}
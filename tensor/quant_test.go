@@ -0,0 +1,111 @@
+package tensor
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestQuantize(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	w := randomTensor(rng, []uint32{8, 96})
+	// a block of zeros and one with a single large value
+	for i := 0; i < QuantBlockSize; i++ {
+		w.Data()[i] = 0
+	}
+	w.Data()[QuantBlockSize+5] = 40
+
+	// Q8_0 is off by at most half a step of amax/127, Q4_0 by a step of
+	// amax/8 for the values on the opposite side of the extreme one
+	for _, c := range []struct {
+		typ   QuantType
+		step  float64
+		bytes uint64
+	}{
+		{Q8_0, 1.0 / 254, 8 * 96 / 32 * (2 + 32)},
+		{Q4_0, 1.0 / 8, 8 * 96 / 32 * (2 + 16)},
+	} {
+		q, err := Quantize(w, c.typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.Type() != c.typ || !reflect.DeepEqual(q.Shape(), []uint32{8, 96}) || q.Bytes() != c.bytes {
+			t.Errorf("%s: got type %s, shape %v and %d bytes", c.typ, q.Type(), q.Shape(), q.Bytes())
+		}
+		d := q.Dequantize()
+		for block := 0; block < len(w.Data())/QuantBlockSize; block++ {
+			xs := w.Data()[block*QuantBlockSize : (block+1)*QuantBlockSize]
+			amax := 0.0
+			for _, x := range xs {
+				amax = max(amax, math.Abs(float64(x)))
+			}
+			// the F16 scale adds a relative error of 2^-11
+			bound := amax * (c.step + 1.0/2048)
+			for i, x := range xs {
+				if got := d.Data()[block*QuantBlockSize+i]; math.Abs(float64(got-x)) > bound {
+					t.Fatalf("%s: element %d of block %d is %v, expected %v within %v", c.typ, i, block, got, x, bound)
+				}
+			}
+		}
+		if got := d.Data()[:QuantBlockSize]; !reflect.DeepEqual(got, make([]float32, QuantBlockSize)) {
+			t.Errorf("%s: the block of zeros became %v", c.typ, got)
+		}
+
+		rows := GatherQuant(q, NewTensor([]uint32{3, 0}, []uint32{2}))
+		if !reflect.DeepEqual(rows.Data(), append(d.Data()[3*96:4*96:4*96], d.Data()[:96]...)) {
+			t.Errorf("%s: GatherQuant differs from the dequantized rows", c.typ)
+		}
+	}
+
+	if _, err := Quantize(randomTensor(rng, []uint32{4, 33}), Q8_0); err == nil {
+		t.Error("expected an error for rows that are not a multiple of the block size")
+	}
+	if _, err := Quantize(randomTensor(rng, []uint32{64}), Q8_0); err == nil {
+		t.Error("expected an error for a 1D tensor")
+	}
+	if _, err := Quantize(w, "Q2"); err == nil {
+		t.Error("expected an error for an unknown type")
+	}
+}
+
+func TestMatMulTransBQuant(t *testing.T) {
+	defer SetMatMulWorkers(0)
+	SetMatMulWorkers(3)
+	rng := rand.New(rand.NewSource(5))
+	for _, dims := range [][3]uint32{{1, 2048, 128}, {7, 130, 64}, {20, 64, 320}} {
+		a := randomTensor(rng, []uint32{dims[0], dims[2]})
+		b := randomTensor(rng, []uint32{dims[1], dims[2]})
+		for _, typ := range []QuantType{Q8_0, Q4_0} {
+			q, err := Quantize(b, typ)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(MatMulTransBQuant(a, q).Data(), MatMulTransB(a, q.Dequantize()).Data()) {
+				t.Errorf("%v: %s product differs from the product with dequantized weights", dims, typ)
+			}
+		}
+	}
+}
+
+func BenchmarkMatMulTransBQuant(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	x := randomTensor(rng, []uint32{1, 2048})
+	w := randomTensor(rng, []uint32{2048, 2048})
+	b.Run("F32", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			MatMulTransB(x, w)
+		}
+	})
+	for _, typ := range []QuantType{Q8_0, Q4_0} {
+		q, err := Quantize(w, typ)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(string(typ), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				MatMulTransBQuant(x, q)
+			}
+		})
+	}
+}
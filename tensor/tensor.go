@@ -7,7 +7,7 @@ import (
 	"strings"
 )
 
-type Tensor[T TensorDataType] struct {
+type Tensor[T ElementType] struct {
 	data   []T
 	shape  []uint32
 	length uint32
@@ -21,7 +21,7 @@ type FloatDataType interface {
 	~float32 | ~float64
 }
 
-func NewTensor[T TensorDataType](data []T, shape []uint32) *Tensor[T] {
+func NewTensor[T ElementType](data []T, shape []uint32) *Tensor[T] {
 	total := calculateSize(shape)
 	// check that the length of the data is the same as the total number of elements
 	if len(data) != int(total) {
@@ -30,7 +30,7 @@ func NewTensor[T TensorDataType](data []T, shape []uint32) *Tensor[T] {
 	return &Tensor[T]{data: data, shape: shape, length: total}
 }
 
-func EmptyTensor[T TensorDataType](shape []uint32) *Tensor[T] {
+func EmptyTensor[T ElementType](shape []uint32) *Tensor[T] {
 	total := calculateSize(shape)
 	return &Tensor[T]{data: make([]T, int(total)), shape: shape, length: total}
 }
@@ -95,13 +95,24 @@ func (t *Tensor[T]) CloseTo(other *Tensor[T], rel float32) (bool, error) {
 	}
 	// type assertion to check if T is a float type
 	for i := range t.Data() {
-		if !FloatEq(float32(t.Data()[i]), float32(other.Data()[i]), rel) {
+		if !FloatEq(elementFloat32(t.Data()[i]), elementFloat32(other.Data()[i]), rel) {
 			return false, nil
 		}
 	}
 	return true, nil
 }
 
+// elementFloat32 converts v to float32, decoding the 16-bit float types.
+func elementFloat32[T ElementType](v T) float32 {
+	switch h := any(v).(type) {
+	case F16:
+		return h.Float32()
+	case BF16:
+		return h.Float32()
+	}
+	return float32(v)
+}
+
 func FloatEq(a, b, rel float32) bool {
 	absDiff := math.Abs(float64(a - b))
 	return absDiff <= float64(rel)*(math.Abs(float64(a))+math.Abs(float64(b)))/2.0